@@ -6,7 +6,7 @@ import (
 	"unicode/utf8"
 )
 
-// Sanitize removes all comments from JSONC data.
+// Sanitize removes all comments and trailing commas from JSONC data.
 // It returns an error if the data is not valid UTF-8.
 //
 // NOTE: it does not checks whether the data is valid JSON or not.
@@ -14,7 +14,7 @@ func Sanitize(data []byte) ([]byte, error) {
 	if !utf8.Valid(data) {
 		return nil, errors.New("jsonc: invalid UTF-8")
 	}
-	return sanitize(data), nil
+	return removeTrailingCommas(sanitize(data)), nil
 }
 
 type state byte
@@ -35,7 +35,8 @@ func sanitize(data []byte) []byte {
 		case '\n':
 			state &^= isCommentLine
 		case '\\':
-			if state&isString != 0 {
+			// an escaped backslash doesn't escape the next rune
+			if state&isString != 0 && !stateCheckNext {
 				state |= checkNext
 			}
 		case '"':
@@ -82,3 +83,43 @@ func sanitize(data []byte) []byte {
 		return r
 	}, data)
 }
+
+// removeTrailingCommas removes commas followed only by whitespace before a
+// closing '}' or ']'. data must not contain comments.
+func removeTrailingCommas(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			out = append(out, c)
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case ',':
+			j := i + 1
+			for j < len(data) && isSpace(data[j]) {
+				j++
+			}
+			if j < len(data) && (data[j] == '}' || data[j] == ']') {
+				continue // skip trailing comma
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,47 @@
+package jsonc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", `{"a": [1, 2]}`, `{"a": [1, 2]}`},
+		{"trailing comma in object", `{"a": 1,}`, `{"a": 1}`},
+		{"trailing comma in array", `[1, 2, ]`, `[1, 2 ]`},
+		{"nested", `{"a": {"b": [1, [2, 3,],],}, "c": {},}`, `{"a": {"b": [1, [2, 3]]}, "c": {}}`},
+		{"newline before closing", "{\n\t\"a\": [\n\t\t1,\n\t],\n}", "{\n\t\"a\": [\n\t\t1\n\t]\n}"},
+		{"comma before comment", "{\"a\": 1, // last\n}", "{\"a\": 1 \n}"},
+		{"comma in string", `{"a": "x,}", "b": ",]",}`, `{"a": "x,}", "b": ",]"}`},
+		{"escaped quote", `{"a": "\",}",}`, `{"a": "\",}"}`},
+		{"escaped backslash", `{"a": "\\",}`, `{"a": "\\"}`},
+		{"comment markers in string", `{"a": "// not a comment", "b": "/* nor this */",}`, `{"a": "// not a comment", "b": "/* nor this */"}`},
+		{"block comment", `{"a": /* one */ 1, /* , ] */}`, `{"a":  1 }`},
+		{"line comment", "[1, // two\n2,]", "[1, \n2]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Sanitize([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Sanitize(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("Sanitize(%q) = %q, not valid JSON", tt.input, got)
+			}
+		})
+	}
+}
+
+func TestSanitizeInvalidUTF8(t *testing.T) {
+	if _, err := Sanitize([]byte{'"', 0xff, '"'}); err == nil {
+		t.Error("expected an error for invalid UTF-8")
+	}
+}
@@ -46,10 +46,22 @@ func (s *State) AddInstance(i *module.Instance) {
 	s.instances[i.Id()] = i
 }
 
+// RemoveInstance removes an instance. When the last instance is removed, the
+// niri connection is closed; the next Init reconnects.
 func (s *State) RemoveInstance(id uintptr) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.instances, id)
+
+	if len(s.instances) == 0 && s.niriState != nil {
+		log.Debugf("last instance removed, disconnecting from niri socket")
+		err := s.niriSocket.Close()
+		if err != nil {
+			log.Warnf("error closing niri socket: %s", err)
+		}
+		s.niriState = nil
+		s.niriSocket = niri.Socket{}
+	}
 }
 
 func (s *State) GetInstance(id uintptr) *module.Instance {
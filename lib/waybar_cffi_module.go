@@ -16,12 +16,16 @@ import (
 #cgo pkg-config: gtk+-3.0
 #include "waybar_cffi_module.h"
 #include <stdio.h>
+#include <signal.h>
 typedef const wbcffi_init_info wbcffi_init_info_t;
 typedef const wbcffi_config_entry wbcffi_config_entry_t;
 typedef const char const_char_t;
 static inline GtkContainer *GetRootWidget(GtkContainer *(*get_root_widget)(wbcffi_module *obj), wbcffi_module *obj) {
 	return get_root_widget(obj);
 }
+static inline int SigRtMin() {
+	return SIGRTMIN;
+}
 static inline void QueueUpdate(void (*queue_update)(wbcffi_module *), wbcffi_module *obj) {
 	queue_update(obj);
 }
@@ -30,6 +34,13 @@ import "C"
 
 var global = state.New()
 
+func init() {
+	err := log.ConfigureFromEnv()
+	if err != nil {
+		log.Warnf("%s", err)
+	}
+}
+
 //export wbcffi_init
 func wbcffi_init(init_info *C.wbcffi_init_info_t,
 	config_entries *C.wbcffi_config_entry_t,
@@ -54,31 +65,21 @@ func wbcffi_init(init_info *C.wbcffi_init_info_t,
 
 	err = i.Preinit(root)
 	if err != nil {
+		i.Deinit()
 		global.RemoveInstance(id)
 		log.Errorf("preinit: %s", err)
 		return nil
 	}
 
 	root.Connect("realize", func(obj *glib.Object) {
+		// the output is known up front, no need to wait for GTK
+		if initFromOutput(i, obj) {
+			return
+		}
 		// let waybar settle
-		glib.TimeoutAdd(100, func() {
-			i := global.GetInstance(id)
-			if i == nil {
-				log.Errorf("realize: instance %x not found", id)
-				return
-			}
-
-			root := gtk.Widget{InitiallyUnowned: glib.InitiallyUnowned{Object: obj}}
-			monitor, screenWidth, screenHeight, err := getMonitorInfo(&root)
-			if err != nil {
-				log.Errorf("realize: %s", err)
-				return
-			}
-
-			log.Debugf("got monitor! id=%x name=%s", id, monitor)
-			i.Init(monitor, screenWidth, screenHeight)
+		glib.TimeoutAdd(i.InitDelay(), func() {
+			resolveMonitor(id, obj, 1)
 		})
-
 	})
 
 	log.Debugf("init from go! id=%x", id)
@@ -87,6 +88,8 @@ func wbcffi_init(init_info *C.wbcffi_init_info_t,
 		log.Tracef("config %s = %s", key, value)
 		err := i.ApplyConfig(key, value)
 		if err != nil {
+			// withdraw whatever the instance registered so far
+			i.Deinit()
 			global.RemoveInstance(id)
 			log.Errorf("%s config: %s", key, err)
 			return nil
@@ -127,7 +130,8 @@ func wbcffi_refresh(instanceId unsafe.Pointer, signal C.int) {
 		log.Errorf("instance %x not found", instanceId)
 		return
 	}
-	i.Refresh(int(signal))
+	// waybar passes the raw signal number; modules are configured relative to SIGRTMIN
+	i.Refresh(int(signal) - int(C.SigRtMin()))
 }
 
 //export wbcffi_doaction
@@ -141,6 +145,94 @@ func wbcffi_doaction(instanceId unsafe.Pointer, action_name *C.const_char_t) {
 	i.DoAction(C.GoString(action_name))
 }
 
+// initFromOutput initializes the instance with the configured output, sizing
+// it from niri instead of GTK. It returns false if no output is configured or
+// niri doesn't know the output, so monitor detection should be used instead.
+func initFromOutput(i *module.Instance, obj *glib.Object) bool {
+	output := i.OutputOverride()
+	if output == "" {
+		return false
+	}
+	outputInfo := func() (string, int, int, error) {
+		width, height, err := global.GetNiriSocket().OutputSize(output)
+		return output, width, height, err
+	}
+	_, width, height, err := outputInfo()
+	if err != nil {
+		log.Warnf("realize: %s, falling back to monitor detection", err)
+		return false
+	}
+	log.Debugf("using configured output! id=%x name=%s", i.Id(), output)
+	i.Init(output, width, height)
+
+	// follow mode and scale changes of the output
+	root := gtk.Widget{InitiallyUnowned: glib.InitiallyUnowned{Object: obj}}
+	followConfigure(i.Id(), &root, outputInfo)
+	return true
+}
+
+// monitorAttempts is how many times resolving the monitor is attempted before
+// giving up (or falling back to following the focused output).
+const monitorAttempts = 10
+
+// resolveMonitor initializes the instance once the monitor the bar is on can
+// be determined, retrying after init-delay-ms if it can't yet.
+func resolveMonitor(id uintptr, obj *glib.Object, attempt int) {
+	i := global.GetInstance(id)
+	if i == nil {
+		log.Errorf("realize: instance %x not found", id)
+		return
+	}
+
+	root := gtk.Widget{InitiallyUnowned: glib.InitiallyUnowned{Object: obj}}
+	monitor, screenWidth, screenHeight, err := getMonitorInfo(&root)
+	if err == nil && monitor == "" && i.OutputOverride() == "" && attempt < monitorAttempts {
+		err = fmt.Errorf("monitor has no name")
+	}
+	if err != nil {
+		if attempt < monitorAttempts {
+			log.Debugf("realize: %s, retrying (attempt %d/%d)", err, attempt, monitorAttempts)
+			glib.TimeoutAdd(i.InitDelay(), func() {
+				resolveMonitor(id, obj, attempt+1)
+			})
+			return
+		}
+		log.Errorf("realize: %s", err)
+		return
+	}
+
+	log.Debugf("got monitor! id=%x name=%s", id, monitor)
+	i.Init(monitor, screenWidth, screenHeight)
+
+	// follow the bar across output hotplug/renames
+	followConfigure(id, &root, func() (string, int, int, error) {
+		return getMonitorInfo(&root)
+	})
+}
+
+// followConfigure updates the instance's monitor from info whenever the bar's
+// toplevel window is reconfigured, e.g. when its output is resized.
+func followConfigure(id uintptr, root *gtk.Widget, info func() (string, int, int, error)) {
+	toplevel, err := root.GetToplevel()
+	if err != nil {
+		log.Errorf("realize: error getting toplevel: %s", err)
+		return
+	}
+	toplevel.ToWidget().Connect("configure-event", func() bool {
+		i := global.GetInstance(id)
+		if i == nil {
+			return false
+		}
+		monitor, screenWidth, screenHeight, err := info()
+		if err != nil {
+			log.Errorf("configure: %s", err)
+			return false
+		}
+		i.UpdateMonitor(monitor, screenWidth, screenHeight)
+		return false
+	})
+}
+
 func wrapContainer(c *C.GtkContainer) *gtk.Container {
 	container := &gtk.Container{}
 	container.Object = &glib.Object{GObject: glib.ToGObject(unsafe.Pointer(c))}
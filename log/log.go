@@ -1,16 +1,24 @@
 package log
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"syscall"
 	"time"
+	"unsafe"
 )
 
 type Logger struct {
-	output io.Writer
-	prefix string
-	level  Level
+	output    io.Writer
+	prefix    string
+	level     Level
+	formatter Formatter
+	tty       bool  // whether output is a terminal
+	color     *bool // overrides tty when set
 }
 
 type Level int
@@ -40,20 +48,108 @@ func (l Level) String() string {
 	}
 }
 
+// Name returns the level's name without color.
+func (l Level) Name() string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warning"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Formatter formats a single log entry, including the trailing newline.
+type Formatter interface {
+	Format(ts time.Time, level Level, prefix string, msg string) []byte
+}
+
+// TextFormatter is the default human-readable format. Loggers set Color when
+// their output is a terminal (see SetColor).
+type TextFormatter struct {
+	Color bool
+}
+
+func (f TextFormatter) Format(ts time.Time, level Level, prefix string, msg string) []byte {
+	var levelName any = level
+	if !f.Color {
+		levelName = level.Name()
+	}
+	b := fmt.Appendf(nil, "[%s] [%s] [%s] %s", ts.Format("2006-01-02 15:04:05.000"), levelName, prefix, msg)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// JSONFormatter writes one JSON object per line with the keys ts, level,
+// prefix, and msg.
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(ts time.Time, level Level, prefix string, msg string) []byte {
+	// marshaling a struct of strings can't fail
+	b, _ := json.Marshal(struct {
+		Ts     string `json:"ts"`
+		Level  string `json:"level"`
+		Prefix string `json:"prefix"`
+		Msg    string `json:"msg"`
+	}{ts.Format(time.RFC3339Nano), level.Name(), prefix, strings.TrimSuffix(msg, "\n")})
+	return append(b, '\n')
+}
+
 func (l *Logger) printf(level Level, format string, args ...any) {
 	if l.level > level || l.output == nil {
 		return
 	}
-	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
-	msg := fmt.Appendf(nil, format, args...)
-	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
-		msg = append(msg, '\n')
+	formatter := l.formatter
+	if formatter == nil {
+		formatter = TextFormatter{}
 	}
-	fmt.Fprintf(l.output, "[%s] [%s] [%s] %s", timestamp, level, l.prefix, msg)
+	if text, ok := formatter.(TextFormatter); ok {
+		text.Color = l.tty
+		if l.color != nil {
+			text.Color = *l.color
+		}
+		formatter = text
+	}
+	l.output.Write(formatter.Format(time.Now(), level, l.prefix, fmt.Sprintf(format, args...)))
 }
 
 func (l *Logger) SetOutput(w io.Writer) {
 	l.output = w
+	l.tty = isTerminal(w)
+}
+
+// SetColor forces colored levels on or off, instead of only coloring them
+// when the output is a terminal.
+func (l *Logger) SetColor(color bool) {
+	l.color = &color
+}
+
+// isTerminal reports whether w is a file referring to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+func (l *Logger) SetFormatter(formatter Formatter) {
+	l.formatter = formatter
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.level = level
 }
 
 func (l *Logger) SetPrefix(prefix string) {
@@ -80,7 +176,13 @@ func (l *Logger) Errorf(format string, args ...any) {
 	l.printf(LevelError, format, args...)
 }
 
-var global = Logger{os.Stderr, "niri-windows", LevelInfo}
+var global = Logger{
+	output:    os.Stderr,
+	prefix:    "niri-windows",
+	level:     LevelInfo,
+	formatter: TextFormatter{},
+	tty:       isTerminal(os.Stderr),
+}
 
 func SetOutput(w io.Writer) {
 	global.SetOutput(w)
@@ -90,6 +192,68 @@ func SetPrefix(prefix string) {
 	global.SetPrefix(prefix)
 }
 
+func SetLevel(level Level) {
+	global.SetLevel(level)
+}
+
+func SetFormatter(formatter Formatter) {
+	global.SetFormatter(formatter)
+}
+
+func SetColor(color bool) {
+	global.SetColor(color)
+}
+
+// ParseLevel parses a level name: trace, debug, info, warn, or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %s (expected trace, debug, info, warn, or error)", s)
+	}
+}
+
+// ConfigureFromEnv sets the level, output, and format from WNW_LOG_LEVEL,
+// WNW_LOG_FILE, and WNW_LOG_FORMAT, if set. The level overrides the one set by
+// build tags. Invalid variables are skipped and reported together, without
+// keeping the others from being applied.
+func ConfigureFromEnv() error {
+	var errs []error
+	switch format := os.Getenv("WNW_LOG_FORMAT"); format {
+	case "", "text":
+	case "json":
+		SetFormatter(JSONFormatter{})
+	default:
+		errs = append(errs, fmt.Errorf("WNW_LOG_FORMAT: unknown format %s (expected text or json)", format))
+	}
+	if env := os.Getenv("WNW_LOG_LEVEL"); env != "" {
+		level, err := ParseLevel(env)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("WNW_LOG_LEVEL: %w", err))
+		} else {
+			SetLevel(level)
+		}
+	}
+	if path := os.Getenv("WNW_LOG_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("WNW_LOG_FILE: %w", err))
+		} else {
+			SetOutput(f)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func Tracef(format string, args ...any) {
 	global.Tracef(format, args...)
 }
@@ -0,0 +1,43 @@
+package log
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigureFromEnv(t *testing.T) {
+	saved := global
+	t.Cleanup(func() { global = saved })
+
+	path := filepath.Join(t.TempDir(), "wnw.log")
+	t.Setenv("WNW_LOG_FORMAT", "yaml")
+	t.Setenv("WNW_LOG_LEVEL", "loud")
+	t.Setenv("WNW_LOG_FILE", path)
+
+	err := ConfigureFromEnv()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, name := range []string{"WNW_LOG_FORMAT", "WNW_LOG_LEVEL"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't mention %s", err, name)
+		}
+	}
+	// the valid variable is still applied
+	if global.output == saved.output {
+		t.Error("WNW_LOG_FILE wasn't applied")
+	}
+	if global.level != saved.level {
+		t.Errorf("level = %s, want it unchanged", global.level.Name())
+	}
+
+	t.Setenv("WNW_LOG_FORMAT", "json")
+	t.Setenv("WNW_LOG_LEVEL", "debug")
+	if err := ConfigureFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := global.formatter.(JSONFormatter); !ok || global.level != LevelDebug {
+		t.Errorf("formatter = %T, level = %s, want JSONFormatter and debug", global.formatter, global.level.Name())
+	}
+}
@@ -0,0 +1,116 @@
+// Package metrics keeps counters for troubleshooting performance. Counting is
+// a single atomic add; counters are only formatted when dumped.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// CounterVec is a set of counters distinguished by the value of one label.
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+// Inc increments the counter for the given label value.
+func (c *CounterVec) Inc(value string) {
+	c.mu.RLock()
+	counter, ok := c.values[value]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		counter, ok = c.values[value]
+		if !ok {
+			counter = new(atomic.Uint64)
+			c.values[value] = counter
+		}
+		c.mu.Unlock()
+	}
+	counter.Add(1)
+}
+
+var (
+	EventsProcessed = &CounterVec{
+		name:   "niri_events_processed_total",
+		help:   "niri events processed, by event type",
+		label:  "type",
+		values: make(map[string]*atomic.Uint64),
+	}
+	Redraws = &Counter{
+		name: "redraws_total",
+		help: "module redraws performed",
+	}
+	TilesCreated = &Counter{
+		name: "tiles_created_total",
+		help: "window tiles created in graphical mode",
+	}
+	Connects = &Counter{
+		name: "niri_connects_total",
+		help: "times the niri event stream was (re)connected",
+	}
+	Resyncs = &Counter{
+		name: "niri_resyncs_total",
+		help: "times the state was queried from niri directly",
+	}
+)
+
+const prefix = "waybar_niri_windows_"
+
+// Write writes every counter to w in the Prometheus text format.
+func Write(w io.Writer) error {
+	for _, c := range []*Counter{Redraws, TilesCreated, Connects, Resyncs} {
+		_, err := fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %[1]s%[2]s counter\n%[1]s%[2]s %[4]d\n",
+			prefix, c.name, c.help, c.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return EventsProcessed.write(w)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %[1]s%[2]s counter\n", prefix, c.name, c.help)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	slices.Sort(values)
+	for _, value := range values {
+		_, err := fmt.Fprintf(w, "%s%s{%s=%q} %d\n", prefix, c.name, c.label, value, c.values[value].Load())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,34 +1,88 @@
 package module
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"wnw/jsonc"
+	"wnw/log"
 	"wnw/niri"
+
+	"github.com/gotk3/gotk3/gdk"
+	"github.com/gotk3/gotk3/pango"
 )
 
 type Config struct {
-	Mode Mode `json:"mode"`
-
-	ShowFloating      ShowFloating     `json:"show-floating"`
-	FloatingPosition  FloatingPosition `json:"floating-position"`
-	MinimumSize       int              `json:"minimum-size"`
-	Spacing           int              `json:"spacing"`
-	IconMinSize       int              `json:"icon-minimum-size"`
-	ColumnBorders     int              `json:"column-borders"`
-	FloatingBorders   int              `json:"floating-borders"`
-	OnTileClick       string           `json:"on-tile-click"`
-	OnTileMiddleClick string           `json:"on-tile-middle-click"`
-	OnTileRightClick  string           `json:"on-tile-right-click"`
-	Symbols           niri.Symbols     `json:"symbols"`
-	WindowRules       WindowRules      `json:"rules"`
+	Mode              Mode              `json:"mode"`
+	OnlyFocusedOutput bool              `json:"only-focused-output"`
+	ShowWhenEmpty     bool              `json:"show-when-empty"`
+	InitDelay         int               `json:"init-delay-ms"`
+	Output            string            `json:"output"`
+	OutputMap         map[string]string `json:"output-map"`
+	CssName           string            `json:"css-name"`
+	CssClass          string            `json:"css-class"`
+
+	Orientation             Orientation       `json:"orientation"`
+	ShowFloating            ShowFloating      `json:"show-floating"`
+	FloatingPosition        FloatingPosition  `json:"floating-position"`
+	FloatingSort            niri.FloatingSort `json:"floating-sort"`
+	ColumnSort              niri.ColumnSort   `json:"column-sort"`
+	MinimumSize             int               `json:"minimum-size"`
+	Spacing                 int               `json:"spacing"`
+	IconMinSize             int               `json:"icon-minimum-size"`
+	ColumnBorders           int               `json:"column-borders"`
+	FloatingBorders         int               `json:"floating-borders"`
+	HeightScale             float64           `json:"height-scale"`
+	MaxWidth                int               `json:"max-width"`
+	ColumnWidth             ColumnWidth       `json:"column-width"`
+	StackThreshold          int               `json:"stack-threshold"`
+	InvertEmphasis          bool              `json:"invert-emphasis"`
+	GroupColumns            bool              `json:"group-columns"`
+	AutoColor               bool              `json:"auto-color"`
+	GraphicalWorkspaceLabel bool              `json:"graphical-workspace-label"`
+	OverviewScale           float64           `json:"overview-scale"`
+	OnTileClick             TileAction        `json:"on-tile-click"`
+	OnTileMiddleClick       TileAction        `json:"on-tile-middle-click"`
+	OnTileShiftClick        TileAction        `json:"on-tile-shift-click"`
+	OnTileRightClick        TileAction        `json:"on-tile-right-click"`
+	TileBindings            TileBindings      `json:"tile-bindings"`
+	TooltipFormat           string            `json:"tooltip-format"`
+	TileCursor              string            `json:"tile-cursor"`
+	TileScrollMove          bool              `json:"tile-scroll-move"`
+	FocusOnHover            bool              `json:"focus-on-hover"`
+	FocusOnHoverDelay       int               `json:"focus-on-hover-delay"`
+	BgScroll                BgScroll          `json:"bg-scroll"`
+	Transition              bool              `json:"transition"`
+	ActionRateLimit         float64           `json:"action-rate-limit"`
+	WatchdogMs              int               `json:"watchdog-ms"`
+	FlashOnScreenshot       bool              `json:"flash-on-screenshot"`
+	Symbols                 niri.Symbols      `json:"symbols"`
+	Separator               string            `json:"separator"`
+	SymbolSeparator         string            `json:"symbol-separator"`
+	UrgentStyle             niri.UrgentStyle  `json:"urgent-style"`
+	SpecialWorkspaces       Regexp            `json:"special-workspaces"`
+	WorkspacePrefixFormat   string            `json:"workspace-prefix-format"`
+	Compact                 bool              `json:"compact"`
+	FloatingCollapse        int               `json:"floating-collapse"`
+	MaxLength               int               `json:"max-length"`
+	Ellipsize               Ellipsize         `json:"ellipsize"`
+	AppAliases              AppAliases        `json:"app-aliases"`
+	WindowRules             WindowRules       `json:"rules"`
+	RulesFile               string            `json:"rules-file"`
+	StatusSignal            int               `json:"status-signal"`
+	MetricsSignal           int               `json:"metrics-signal"`
 }
 
 type Mode string
 
 const (
-	TextMode      Mode = "text"
-	GraphicalMode Mode = "graphical"
+	TextMode       Mode = "text"
+	GraphicalMode  Mode = "graphical"
+	WorkspacesMode Mode = "workspaces"
 )
 
 func (m *Mode) UnmarshalJSON(data []byte) error {
@@ -42,8 +96,32 @@ func (m *Mode) UnmarshalJSON(data []byte) error {
 		*m = TextMode
 	case "graphical":
 		*m = GraphicalMode
+	case "workspaces":
+		*m = WorkspacesMode
 	default:
-		return fmt.Errorf("unknown mode %s (expected text or graphical)", s)
+		return fmt.Errorf("unknown mode %s (expected text, graphical, or workspaces)", s)
+	}
+	return nil
+}
+
+type Orientation string
+
+const (
+	OrientationHorizontal Orientation = "horizontal"
+	OrientationVertical   Orientation = "vertical"
+)
+
+func (o *Orientation) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "horizontal", "vertical":
+		*o = Orientation(s)
+	default:
+		return fmt.Errorf("unknown orientation value %s (expected horizontal or vertical)", s)
 	}
 	return nil
 }
@@ -93,48 +171,440 @@ func (f *FloatingPosition) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type ColumnWidth string
+
+const (
+	ColumnWidthTile  ColumnWidth = "tile"
+	ColumnWidthCount ColumnWidth = "count"
+	ColumnWidthEqual ColumnWidth = "equal"
+)
+
+func (c *ColumnWidth) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "tile", "count", "equal":
+		*c = ColumnWidth(s)
+	default:
+		return fmt.Errorf("unknown column-width value %s (expected tile, count, or equal)", s)
+	}
+	return nil
+}
+
+type BgScroll string
+
+const (
+	BgScrollWorkspace BgScroll = "workspace"
+	BgScrollColumn    BgScroll = "column"
+	BgScrollNone      BgScroll = "none"
+)
+
+func (b *BgScroll) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "workspace", "column", "none":
+		*b = BgScroll(s)
+	default:
+		return fmt.Errorf("unknown bg-scroll value %s (expected workspace, column, or none)", s)
+	}
+	return nil
+}
+
+type Ellipsize string
+
+const (
+	EllipsizeStart  Ellipsize = "start"
+	EllipsizeMiddle Ellipsize = "middle"
+	EllipsizeEnd    Ellipsize = "end"
+	EllipsizeNone   Ellipsize = "none"
+)
+
+func (e *Ellipsize) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "start", "middle", "end", "none":
+		*e = Ellipsize(s)
+	default:
+		return fmt.Errorf("unknown ellipsize value %s (expected start, middle, end, or none)", s)
+	}
+	return nil
+}
+
+// PangoMode returns the pango ellipsize mode for the value.
+func (e Ellipsize) PangoMode() pango.EllipsizeMode {
+	switch e {
+	case EllipsizeStart:
+		return pango.ELLIPSIZE_START
+	case EllipsizeMiddle:
+		return pango.ELLIPSIZE_MIDDLE
+	case EllipsizeNone:
+		return pango.ELLIPSIZE_NONE
+	default:
+		return pango.ELLIPSIZE_END
+	}
+}
+
+// Regexp is a regular expression that unmarshals from a JSON string.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (r *Regexp) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	if s == "" {
+		r.Regexp = nil
+		return nil
+	}
+	r.Regexp, err = regexp.Compile(s)
+	if err != nil {
+		return fmt.Errorf("invalid regex %s: %w", s, err)
+	}
+	return nil
+}
+
+type RuleFloating string
+
+const (
+	RuleFloatingAny   RuleFloating = "any"
+	RuleFloatingTrue  RuleFloating = "true"
+	RuleFloatingFalse RuleFloating = "false"
+)
+
+func (f *RuleFloating) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "any", "true", "false":
+		*f = RuleFloating(s)
+	default:
+		return fmt.Errorf("unknown floating value %s (expected true, false, or any)", s)
+	}
+	return nil
+}
+
+// Matches reports whether a window with the given floating state satisfies
+// the condition.
+func (f RuleFloating) Matches(isFloating bool) bool {
+	switch f {
+	case RuleFloatingTrue:
+		return isFloating
+	case RuleFloatingFalse:
+		return !isFloating
+	default:
+		return true
+	}
+}
+
 type WindowRuleConfig struct {
-	AppId    string `json:"app-id"`
-	Title    string `json:"title"`
-	Class    string `json:"class"`
-	Icon     string `json:"icon"`
-	Continue bool   `json:"continue"`
+	AppId      string       `json:"app-id"`
+	Title      string       `json:"title"`
+	Workspace  string       `json:"workspace"`
+	Floating   RuleFloating `json:"floating"`
+	IgnoreCase bool         `json:"ignore-case"`
+	Class      string       `json:"class"`
+	Icon       string       `json:"icon"`
+	Continue   bool         `json:"continue"`
 }
 
 type WindowRule struct {
-	AppId    *regexp.Regexp
-	Title    *regexp.Regexp
-	Class    string
-	Icon     string
-	Continue bool
+	AppId     *regexp.Regexp
+	Title     *regexp.Regexp
+	Workspace *regexp.Regexp
+	Floating  RuleFloating
+	Class     string
+	Icon      string
+	Continue  bool
 }
 
 type WindowRules []WindowRule
 
 func (w *WindowRules) UnmarshalJSON(data []byte) error {
-	var rules []WindowRuleConfig
+	var rules []json.RawMessage
 	err := json.Unmarshal(data, &rules)
 	if err != nil {
 		return fmt.Errorf("error unmarshaling rules: %w", err)
 	}
-	s := make([]WindowRule, len(rules))
-	for idx, rule := range rules {
-		if rule.AppId != "" {
-			s[idx].AppId, err = regexp.Compile(rule.AppId)
-			if err != nil {
-				return fmt.Errorf("invalid app-id regex: %w", err)
-			}
+	s := make([]WindowRule, 0, len(rules))
+	for idx, data := range rules {
+		// don't take down the whole module because of one bad rule
+		var rule WindowRuleConfig
+		err := json.Unmarshal(data, &rule)
+		if err != nil {
+			log.Errorf("skipping rule %d: %s", idx, err)
+			continue
 		}
-		if rule.Title != "" {
-			s[idx].Title, err = regexp.Compile(rule.Title)
-			if err != nil {
-				return fmt.Errorf("invalid title regex: %w", err)
-			}
+		compiled, err := rule.compile()
+		if err != nil {
+			log.Errorf("skipping rule %d: %s", idx, err)
+			continue
 		}
-		s[idx].Class = rule.Class
-		s[idx].Icon = rule.Icon
-		s[idx].Continue = rule.Continue
+		s = append(s, compiled)
 	}
 	*w = s
 	return nil
 }
+
+// AppAlias maps App IDs matching a regex to a display name.
+type AppAlias struct {
+	AppId *regexp.Regexp
+	Name  string
+}
+
+// AppAliases are checked in the order they are defined; the first match wins.
+type AppAliases []AppAlias
+
+// UnmarshalJSON reads an object mapping App ID regexes to display names,
+// preserving the order of its keys.
+func (a *AppAliases) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("error unmarshaling app-aliases: %w", err)
+	}
+	if token != json.Delim('{') {
+		return fmt.Errorf("app-aliases must be an object")
+	}
+	aliases := AppAliases{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("error unmarshaling app-aliases: %w", err)
+		}
+		expr := token.(string) // object keys are always strings
+		var name string
+		err = decoder.Decode(&name)
+		if err != nil {
+			return fmt.Errorf("error unmarshaling app-aliases: %s: %w", expr, err)
+		}
+		appId, err := regexp.Compile(expr)
+		if err != nil {
+			// don't take down the whole module because of one bad alias
+			log.Errorf("skipping app alias %s: %s", expr, err)
+			continue
+		}
+		aliases = append(aliases, AppAlias{AppId: appId, Name: name})
+	}
+	*a = aliases
+	return nil
+}
+
+// Name returns the display name for an App ID, which is the App ID itself if
+// no alias matches.
+func (a AppAliases) Name(appId string) string {
+	for _, alias := range a {
+		if alias.AppId.MatchString(appId) {
+			return alias.Name
+		}
+	}
+	return appId
+}
+
+// TileBinding is a mouse button together with the modifiers that must be held
+// when it is pressed.
+type TileBinding struct {
+	Modifiers gdk.ModifierType
+	Button    uint
+}
+
+// bindingModifiers are the modifiers that can be used in tile-bindings. Other
+// modifiers (e.g. Caps Lock) are ignored when matching.
+var bindingModifiers = map[string]gdk.ModifierType{
+	"ctrl":  gdk.CONTROL_MASK,
+	"shift": gdk.SHIFT_MASK,
+	"alt":   gdk.MOD1_MASK,
+	"super": gdk.SUPER_MASK,
+}
+
+const bindingModifierMask = gdk.CONTROL_MASK | gdk.SHIFT_MASK | gdk.MOD1_MASK | gdk.SUPER_MASK
+
+var bindingButtons = map[string]uint{
+	"left":   uint(gdk.BUTTON_PRIMARY),
+	"middle": uint(gdk.BUTTON_MIDDLE),
+	"right":  uint(gdk.BUTTON_SECONDARY),
+}
+
+// parseTileBinding parses a binding like "ctrl+shift+left". The last part is
+// the button, either a name or a button number; the rest are modifiers.
+func parseTileBinding(s string) (binding TileBinding, err error) {
+	parts := strings.Split(strings.ToLower(s), "+")
+	button := parts[len(parts)-1]
+	if b, ok := bindingButtons[button]; ok {
+		binding.Button = b
+	} else if b, err := strconv.ParseUint(button, 10, 32); err == nil && b > 0 {
+		binding.Button = uint(b)
+	} else {
+		return binding, fmt.Errorf("unknown button %s (expected left, middle, right, or a button number)", button)
+	}
+	for _, modifier := range parts[:len(parts)-1] {
+		mask, ok := bindingModifiers[modifier]
+		if !ok {
+			return binding, fmt.Errorf("unknown modifier %s (expected ctrl, shift, alt, or super)", modifier)
+		}
+		binding.Modifiers |= mask
+	}
+	return binding, nil
+}
+
+// TileAction is an action for tile clicks: either the name of a niri action
+// that takes a window ID (or a pseudo-action), or a full niri action object
+// whose "{id}" placeholders are replaced with the window ID, stored as JSON.
+type TileAction string
+
+func (a *TileAction) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*a = TileAction(name)
+		return nil
+	}
+	var action map[string]json.RawMessage
+	err := json.Unmarshal(data, &action)
+	if err != nil {
+		return fmt.Errorf("tile action must be an action name or a niri action object")
+	}
+	if len(action) != 1 {
+		return fmt.Errorf("niri action object must have exactly one key (the action name), got %d", len(action))
+	}
+	compact := new(bytes.Buffer)
+	err = json.Compact(compact, data)
+	if err != nil {
+		return err
+	}
+	*a = TileAction(compact.String())
+	return nil
+}
+
+// IsCustom reports whether the action is a niri action object.
+func (a TileAction) IsCustom() bool {
+	return strings.HasPrefix(string(a), "{")
+}
+
+// Request returns the niri request for a custom action, with "{id}" replaced
+// with the window ID: strings that are exactly "{id}" become the number, and
+// any other occurrences are substituted as text.
+func (a TileAction) Request(id uint64) (map[string]any, error) {
+	var action any
+	err := json.Unmarshal([]byte(a), &action)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"Action": substituteId(action, id)}, nil
+}
+
+func substituteId(v any, id uint64) any {
+	switch v := v.(type) {
+	case string:
+		if v == "{id}" {
+			return id
+		}
+		return strings.ReplaceAll(v, "{id}", strconv.FormatUint(id, 10))
+	case map[string]any:
+		for key, value := range v {
+			v[key] = substituteId(value, id)
+		}
+	case []any:
+		for idx, value := range v {
+			v[idx] = substituteId(value, id)
+		}
+	}
+	return v
+}
+
+// TileBindings maps modifier+button combinations to tile click actions.
+type TileBindings map[TileBinding]TileAction
+
+func (t *TileBindings) UnmarshalJSON(data []byte) error {
+	var raw map[string]TileAction
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	bindings := TileBindings{}
+	for key, action := range raw {
+		binding, err := parseTileBinding(key)
+		if err != nil {
+			return fmt.Errorf("tile-bindings: %s: %w", key, err)
+		}
+		bindings[binding] = action
+	}
+	*t = bindings
+	return nil
+}
+
+// Action returns the action bound to a button press with the given modifier
+// state, if any.
+func (t TileBindings) Action(state gdk.ModifierType, button uint) (TileAction, bool) {
+	action, ok := t[TileBinding{Modifiers: state & bindingModifierMask, Button: button}]
+	return action, ok
+}
+
+// loadRulesFile reads window rules from a JSONC file containing an array of
+// rules, in the same format as the "rules" config option.
+func loadRulesFile(path string) (WindowRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %w", err)
+	}
+	sanitized, err := jsonc.Sanitize(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %w", err)
+	}
+	var rules WindowRules
+	err = json.Unmarshal(sanitized, &rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (rule WindowRuleConfig) compile() (compiled WindowRule, err error) {
+	compile := regexp.Compile
+	if rule.IgnoreCase {
+		compile = func(expr string) (*regexp.Regexp, error) {
+			return regexp.Compile("(?i)" + expr)
+		}
+	}
+	if rule.AppId != "" {
+		compiled.AppId, err = compile(rule.AppId)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid app-id regex: %w", err)
+		}
+	}
+	if rule.Title != "" {
+		compiled.Title, err = compile(rule.Title)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid title regex: %w", err)
+		}
+	}
+	if rule.Workspace != "" {
+		compiled.Workspace, err = compile(rule.Workspace)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid workspace regex: %w", err)
+		}
+	}
+	compiled.Floating = rule.Floating
+	if compiled.Floating == "" {
+		compiled.Floating = RuleFloatingAny
+	}
+	compiled.Class = rule.Class
+	compiled.Icon = rule.Icon
+	compiled.Continue = rule.Continue
+	return compiled, nil
+}
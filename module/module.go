@@ -3,34 +3,55 @@ package module
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"math/rand/v2"
+	"os"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 	"wnw/jsonc"
 	"wnw/log"
+	"wnw/metrics"
 	"wnw/niri"
 
 	"github.com/gotk3/gotk3/gdk"
+	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
+	"github.com/gotk3/gotk3/pango"
 )
 
 type Instance struct {
 	mu              sync.RWMutex
 	id              uintptr
 	queueUpdate     func()
+	root            *gtk.Container
 	box             *gtk.Box
 	label           *gtk.Label // only set in text mode
 	floatingView    *gtk.Box
 	floatingFixed   *gtk.Fixed
+	floatingTiles   map[uint64]floatingTile
+	tiledView       *gtk.Box
+	workspaceLabel  *gtk.Label
+	contextMenu     *gtk.Menu
+	emptyMarker     *gtk.Box
+	hoverTimer      glib.SourceHandle // pending focus-on-hover, if non-zero
+	tiledKey        string
+	columnBoxes     []*gtk.Box
+	hiddenLabels    []*gtk.Label // "+N" indicators of columns with cut windows
+	tiles           map[uint64]*gtk.EventBox
 	monitor         string
 	ready           bool
+	visible         bool // whether the root widget is mapped
 	niriState       *niri.State
 	niriSocket      niri.Socket
 	screenHeight    int
 	screenWidth     int
 	allocatedHeight int
+	signal          int
 	config          Config
 }
 
@@ -39,12 +60,20 @@ func (i *Instance) Id() uintptr {
 	return i.id
 }
 
-// assumes maximum "normal" window height is 90% of screen height
-// TODO: compute real value somehow? tile position isn't known for tiled windows;
-// see https://github.com/YaLTeR/niri/issues/2381
-const screenHeightScale = 0.90
+// when niri doesn't report tile positions for tiled windows (see
+// https://github.com/YaLTeR/niri/issues/2381), assume maximum "normal" window
+// height is 90% of screen height by default; configurable with height-scale
+const defaultHeightScale = 0.90
+
+// time to let waybar settle after the module is realized before resolving the
+// monitor it's on; configurable with init-delay-ms
+const defaultInitDelay = 100
+
+// symbols.empty in text mode if show-when-empty is enabled and it isn't set
+const defaultEmptySymbol = "◌"
 
 const floatingViewName = "floating"
+const tiledViewName = "tiled"
 
 func New(niriState *niri.State, niriSocket niri.Socket, queueUpdate func()) *Instance {
 	return &Instance{
@@ -54,20 +83,37 @@ func New(niriState *niri.State, niriSocket niri.Socket, queueUpdate func()) *Ins
 		niriSocket:  niriSocket,
 		config: Config{
 			Mode:              GraphicalMode,
+			Orientation:       OrientationHorizontal,
 			ShowFloating:      ShowFloatingAuto,
 			FloatingPosition:  FloatingPositionRight,
+			FloatingSort:      niri.FloatingSortPosition,
+			ColumnSort:        niri.ColumnSortPosition,
+			BgScroll:          BgScrollNone,
+			ColumnWidth:       ColumnWidthTile,
+			InitDelay:         defaultInitDelay,
+			FocusOnHoverDelay: 300,
+			TileCursor:        "pointer",
 			MinimumSize:       1,
 			Spacing:           1,
 			ColumnBorders:     0,
 			FloatingBorders:   0,
+			HeightScale:       defaultHeightScale,
+			OverviewScale:     1,
 			OnTileClick:       "FocusWindow",
 			OnTileMiddleClick: "CloseWindow",
-			OnTileRightClick:  "",
+			OnTileShiftClick:  focusColumnAction,
+			OnTileRightClick:  contextMenuAction,
+			Separator:         " ",
+			UrgentStyle:       niri.UrgentStyleColor,
+			Ellipsize:         EllipsizeEnd,
 			Symbols: niri.Symbols{
 				Unfocused:         "⋅",
 				Focused:           "⊙",
 				UnfocusedFloating: "∗",
 				FocusedFloating:   "⊛",
+				WorkspaceActive:   "●",
+				WorkspaceOccupied: "○",
+				WorkspaceEmpty:    "◌",
 			},
 			WindowRules: []WindowRule{},
 		},
@@ -88,6 +134,14 @@ const defaultStylesheet = `
 	background-color: rgba(255, 255, 255, 0.600);
 }
 
+.cffi-niri-windows .empty {
+	background-color: rgba(255, 255, 255, 0.125);
+}
+
+.cffi-niri-windows .workspace.urgent label {
+	color: rgb(251, 44, 54);
+}
+
 .cffi-niri-windows .tile.urgent {
 	background-color: rgba(251, 44, 54, 0.5);
 	border: 1px solid rgba(251, 44, 54, 0.8);
@@ -96,6 +150,12 @@ const defaultStylesheet = `
 .cffi-niri-windows .tile.urgent:hover {
 	background-color: rgba(251, 44, 54, 0.625);
 }
+
+/* opt in with: animation: niri-windows-urgent-pulse 1s ease-in-out infinite alternate; */
+@keyframes niri-windows-urgent-pulse {
+	from { background-color: rgba(251, 44, 54, 0.5); }
+	to { background-color: rgba(251, 44, 54, 0.15); }
+}
 `
 
 func (i *Instance) Preinit(root *gtk.Container) error {
@@ -108,9 +168,10 @@ func (i *Instance) Preinit(root *gtk.Container) error {
 		return fmt.Errorf("error getting style context: %s", err)
 	}
 	style.AddClass("cffi-niri-windows")
+	i.root = root
 
 	cssProvider, _ := gtk.CssProviderNew()
-	err = cssProvider.LoadFromData(defaultStylesheet)
+	err = cssProvider.LoadFromData(autoColorStylesheet() + defaultStylesheet)
 	if err != nil {
 		return fmt.Errorf("error loading default stylesheet: %w", err)
 	}
@@ -124,6 +185,26 @@ func (i *Instance) Preinit(root *gtk.Container) error {
 	root.Add(box)
 	i.box = box
 
+	// skip rebuilding while the bar is hidden (e.g. on fullscreen) and catch
+	// up once it's shown again
+	root.Connect("map", func() {
+		i.mu.Lock()
+		i.visible = true
+		i.mu.Unlock()
+		i.Notify()
+	})
+	root.Connect("unmap", func() {
+		i.mu.Lock()
+		i.visible = false
+		i.mu.Unlock()
+	})
+
+	// the box has no window of its own, so scroll events over the background
+	// are delivered to the root event box; tiles that handle a scroll stop it
+	// from getting there
+	root.AddEvents(int(gdk.SCROLL_MASK | gdk.SMOOTH_SCROLL_MASK))
+	root.Connect("scroll-event", i.onBackgroundScroll)
+
 	return nil
 }
 
@@ -153,7 +234,59 @@ func (i *Instance) ApplyConfig(key, value string) error {
 			log.Warnf("icon-minimum-size must be at least 0, setting to 0")
 			i.config.IconMinSize = 0
 		}
+		if i.config.HeightScale <= 0 || i.config.HeightScale > 1 {
+			log.Warnf("height-scale must be in (0, 1], setting to %.2f", defaultHeightScale)
+			i.config.HeightScale = defaultHeightScale
+		}
+		if i.config.OverviewScale <= 0 || i.config.OverviewScale > 1 {
+			log.Warnf("overview-scale must be in (0, 1], setting to 1")
+			i.config.OverviewScale = 1
+		}
+		if i.config.FocusOnHoverDelay < 0 {
+			log.Warnf("focus-on-hover-delay must be at least 0, setting to 0")
+			i.config.FocusOnHoverDelay = 0
+		}
+		if i.config.MaxLength < 0 {
+			log.Warnf("max-length must be at least 0, setting to 0")
+			i.config.MaxLength = 0
+		}
+		if i.config.ShowWhenEmpty && i.config.Symbols.Empty == "" {
+			i.config.Symbols.Empty = defaultEmptySymbol
+		}
+		if i.config.InitDelay < 0 {
+			log.Warnf("init-delay-ms must be at least 0, setting to %d", defaultInitDelay)
+			i.config.InitDelay = defaultInitDelay
+		}
+		if i.config.ActionRateLimit < 0 {
+			log.Warnf("action-rate-limit must be at least 0, setting to 0")
+			i.config.ActionRateLimit = 0
+		}
+		i.niriSocket.SetRateLimit(uint64(i.id), i.config.ActionRateLimit)
+		i.niriState.SetSortsByRecency(uint64(i.id), i.config.ColumnSort == niri.ColumnSortRecency)
+		i.niriState.SetFlashesScreenshots(uint64(i.id), i.config.FlashOnScreenshot)
+		i.niriState.SetScalesOverview(uint64(i.id), i.config.OverviewScale != 1)
+		if i.config.WatchdogMs < 0 {
+			log.Warnf("watchdog-ms must be at least 0, setting to 0")
+			i.config.WatchdogMs = 0
+		}
+		i.niriSocket.SetWatchdog(uint64(i.id), time.Duration(i.config.WatchdogMs)*time.Millisecond)
+		i.applyCssNames()
+		if i.config.RulesFile != "" {
+			rules, err := loadRulesFile(i.config.RulesFile)
+			if err != nil {
+				// keep the inline rules rather than failing the module
+				log.Errorf("rules-file: %s", err)
+			} else {
+				i.config.WindowRules = rules
+			}
+		}
 		log.Debugf("config: %#+v", i.config)
+	case "signal":
+		signal, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid signal: %w", err)
+		}
+		i.signal = signal
 	case "module_path", "actions":
 		// ignore
 	default:
@@ -164,16 +297,74 @@ func (i *Instance) ApplyConfig(key, value string) error {
 
 func (i *Instance) Init(monitor string, screenWidth, screenHeight int) {
 	i.mu.Lock()
+	monitor = i.outputName(monitor)
 	i.monitor = monitor
 	i.screenWidth = screenWidth
 	i.screenHeight = screenHeight
 	i.box.SetSpacing(i.config.Spacing)
+	outer, _ := i.orientations()
+	i.box.SetOrientation(outer)
 
 	i.ready = true
 	i.mu.Unlock()
 
 	i.Notify()
-	i.niriState.OnUpdate(uint64(i.id), func(state *niri.State) { i.Notify() })
+	i.niriState.OnUpdate(uint64(i.id), func(state *niri.State, change niri.Change) {
+		// don't rebuild this module for events on other monitors
+		i.mu.RLock()
+		affected := change.Affects(i.monitor)
+		i.mu.RUnlock()
+		if affected {
+			i.Notify()
+		}
+	})
+}
+
+// InitDelay returns how long to wait, in milliseconds, before resolving the
+// monitor after the module is realized, and between retries if that fails.
+func (i *Instance) InitDelay() uint {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return uint(i.config.InitDelay)
+}
+
+// outputName returns the niri output name for a monitor name reported by GDK,
+// applying output and output-map. Must be called with the lock held.
+func (i *Instance) outputName(monitor string) string {
+	if i.config.Output != "" {
+		return i.config.Output
+	}
+	if name, ok := i.config.OutputMap[monitor]; ok {
+		return name
+	}
+	return monitor
+}
+
+// OutputOverride returns the configured output, which takes precedence over
+// the monitor detected from the widget, or "" if none is configured.
+func (i *Instance) OutputOverride() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.config.Output
+}
+
+// UpdateMonitor updates the monitor this instance is displayed on, e.g. after
+// an output is reconnected or renamed.
+func (i *Instance) UpdateMonitor(monitor string, screenWidth, screenHeight int) {
+	i.mu.Lock()
+	monitor = i.outputName(monitor)
+	changed := i.monitor != monitor || i.screenWidth != screenWidth || i.screenHeight != screenHeight
+	if changed {
+		log.Debugf("monitor changed: %s (%dx%d) -> %s (%dx%d)", i.monitor, i.screenWidth, i.screenHeight, monitor, screenWidth, screenHeight)
+		i.monitor = monitor
+		i.screenWidth = screenWidth
+		i.screenHeight = screenHeight
+	}
+	i.mu.Unlock()
+
+	if changed {
+		i.Notify()
+	}
 }
 
 func (i *Instance) Deinit() {
@@ -181,6 +372,9 @@ func (i *Instance) Deinit() {
 	defer i.mu.Unlock()
 
 	i.niriState.RemoveOnUpdate(uint64(i.id))
+	i.niriSocket.SetRateLimit(uint64(i.id), 0)
+	i.niriSocket.SetWatchdog(uint64(i.id), 0)
+	i.cancelHoverFocus()
 	i.ready = false
 }
 
@@ -198,51 +392,56 @@ func (i *Instance) Update() {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	if !i.ready {
+	if !i.ready || !i.visible {
 		return
 	}
+	metrics.Redraws.Inc()
 
-	if i.config.Mode == TextMode {
-		text := i.niriState.Text(i.monitor, i.config.Symbols)
+	if i.config.OnlyFocusedOutput && i.monitor != "" && i.niriState.FocusedOutput() != i.monitor {
+		i.box.Hide()
+		return
+	}
+	i.box.Show()
 
-		if text == "" {
-			if i.label != nil {
-				i.label.Destroy()
-				i.label = nil
-			}
-			return
-		}
-		if i.label == nil {
-			var err error
-			i.label, err = gtk.LabelNew("")
-			if err != nil {
-				log.Errorf("error creating label: %s", err)
-				return
-			}
-			i.box.Add(i.label)
-			i.label.Show()
-		}
-		i.label.SetText(text)
+	boxStyle, _ := i.box.GetStyleContext()
+	toggleClass(boxStyle, "disconnected", i.niriState.Disconnected())
+	toggleClass(boxStyle, "screenshot", i.config.FlashOnScreenshot && i.niriState.ScreenshotFlash())
+
+	if i.config.Mode == TextMode {
+		i.drawText()
+		return
+	}
+	if i.config.Mode == WorkspacesMode {
+		i.drawWorkspaces()
 		return
 	}
 
-	tiled, floating := i.niriState.Windows(i.monitor)
+	tiled, floating := i.niriState.Windows(i.monitor, i.sortOptions())
 
-	i.box.GetChildren().Foreach(func(child any) {
-		w := child.(*gtk.Widget)
-		if n, err := w.GetName(); err != nil || n != floatingViewName {
-			w.Destroy()
-		}
-	})
+	// let special workspaces (e.g. scratchpads) be styled or hidden with CSS
+	toggleClass(boxStyle, "special", i.isSpecialWorkspace())
 
+	vertical := i.config.Orientation == OrientationVertical
 	if i.allocatedHeight == 0 {
-		i.allocatedHeight = i.box.GetAllocatedHeight()
+		// on vertical bars, columns are laid out along the bar and stack their
+		// windows across its width
+		if vertical {
+			i.allocatedHeight = i.box.GetAllocatedWidth()
+		} else {
+			i.allocatedHeight = i.box.GetAllocatedHeight()
+		}
 	}
 
 	maxHeight := i.allocatedHeight
-	scale := float64(maxHeight) / float64(i.screenHeight)
+	scale := barScale(maxHeight, i.screenHeight)
 	maxWidth := int(math.Round(float64(i.screenWidth) * scale))
 
+	// zoom out while the overview is open
+	overview := i.config.OverviewScale != 1 && i.niriState.OverviewOpen()
+	if overview {
+		scale *= i.config.OverviewScale
+	}
+
 	columns := groupBy(tiled, func(w *niri.Window) uint32 {
 		return w.Layout.PosInScrollingLayout.X
 	})
@@ -255,68 +454,768 @@ func (i *Instance) Update() {
 		i.config.MinimumSize = maxHeight
 	}
 
-	if i.config.FloatingPosition == FloatingPositionLeft {
-		i.drawFloating(maxWidth, maxHeight, floating, scale)
+	viewHeight := workspaceViewHeight(tiled)
+	if viewHeight == 0 {
+		viewHeight = float64(i.screenHeight) * i.config.HeightScale
+	}
+
+	layouts := make([]columnLayout, len(columns))
+	for idx, column := range columns {
+		layouts[idx] = i.layoutColumn(column, scale, maxHeight, viewHeight)
+	}
+
+	if i.config.ColumnWidth != ColumnWidthTile {
+		redistributeWidths(layouts, i.config.ColumnWidth)
 	}
 
-	var cols *gtk.Box
+	overflow := 0
+	if !overview {
+		layouts, overflow = i.fitMaxWidth(layouts)
+	}
+	if i.config.GroupColumns {
+		groupColumns(layouts)
+	}
+
+	// with transitions enabled, keep the existing tiles around if the layout
+	// didn't change so CSS transitions have a state to animate from
+	key := tiledLayoutKey(layouts, overflow)
+	reuse := i.config.Transition && i.tiledView != nil && key == i.tiledKey
+	if !reuse {
+		// the hovered tile is about to be destroyed
+		i.cancelHoverFocus()
+		i.box.GetChildren().Foreach(func(child any) {
+			w := child.(*gtk.Widget)
+			if n, err := w.GetName(); err != nil || n != floatingViewName {
+				w.Destroy()
+			}
+		})
+		i.tiledView = nil
+		i.workspaceLabel = nil
+		i.emptyMarker = nil
+		i.tiledKey = key
+	}
+
+	if i.config.GraphicalWorkspaceLabel {
+		i.drawWorkspaceLabel()
+	}
 
 	if len(tiled) != 0 {
-		cols, _ = gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, i.config.Spacing)
-		i.box.Add(cols)
+		if !reuse {
+			i.drawTiled(layouts, overflow)
+		}
+		for idx, layout := range layouts {
+			i.updateColumn(idx, layout)
+		}
+	}
 
-		for _, column := range columns {
-			colBox, _ := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, i.config.Spacing)
-			colStyle, _ := colBox.GetStyleContext()
-			colStyle.AddClass("column")
-			cols.Add(colBox)
+	if vertical {
+		// the floating view is a miniature of the screen, which has to fit
+		// the width of the bar instead
+		floatingScale := float64(i.allocatedHeight) / float64(i.screenWidth)
+		floatingHeight := int(math.Round(float64(i.screenHeight) * floatingScale))
+		i.drawFloating(i.allocatedHeight, floatingHeight, floating, floatingScale)
+	} else {
+		i.drawFloating(maxWidth, maxHeight, floating, scale)
+	}
+	i.drawEmptyMarker(len(tiled) == 0 && i.floatingView == nil, maxHeight-i.config.ColumnBorders)
+	if i.config.FloatingPosition == FloatingPositionLeft && i.floatingView != nil {
+		i.box.ReorderChild(i.floatingView, 0)
+	} else if i.config.FloatingPosition == FloatingPositionRight && i.tiledView != nil {
+		i.box.ReorderChild(i.tiledView, 0)
+	}
+	if i.workspaceLabel != nil {
+		i.box.ReorderChild(i.workspaceLabel, 0)
+	}
 
-			windowHeights, width := i.calculateWindowSizes(column, scale, maxHeight-i.config.ColumnBorders)
+	i.box.ShowAll()
+}
 
-			for idx, window := range column {
-				if idx > len(windowHeights)-1 {
-					// we had to cut this window to fit into the bar, stop here
-					break
-				}
-				height := windowHeights[idx]
+// drawEmptyMarker shows a small .empty box in place of the windows when the
+// workspace is empty and show-when-empty is enabled, so the module doesn't
+// collapse entirely.
+func (i *Instance) drawEmptyMarker(empty bool, height int) {
+	if !empty || !i.config.ShowWhenEmpty {
+		if i.emptyMarker != nil {
+			i.emptyMarker.Destroy()
+			i.emptyMarker = nil
+		}
+		return
+	}
+	if i.emptyMarker != nil {
+		return
+	}
 
-				windowBox, _ := gtk.EventBoxNew()
-				windowBox.SetSizeRequest(width, height)
+	var err error
+	i.emptyMarker, err = gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 0)
+	if err != nil {
+		log.Errorf("error creating box: %s", err)
+		return
+	}
+	if i.config.Orientation == OrientationVertical {
+		i.emptyMarker.SetSizeRequest(height, i.config.MinimumSize)
+	} else {
+		i.emptyMarker.SetSizeRequest(i.config.MinimumSize, height)
+	}
+	style, _ := i.emptyMarker.GetStyleContext()
+	style.AddClass("empty")
+	i.box.Add(i.emptyMarker)
+}
 
-				style, _ := windowBox.GetStyleContext()
-				style.AddClass("tile")
-				if window.IsUrgent && !style.HasClass("urgent") {
-					style.AddClass("urgent")
-				} else if !window.IsUrgent && style.HasClass("urgent") {
-					style.RemoveClass("urgent")
-				}
-				if window.IsFocused {
-					windowBox.SetStateFlags(gtk.STATE_FLAG_ACTIVE, false)
-					colBox.SetStateFlags(gtk.STATE_FLAG_ACTIVE, false)
-				}
+// autoColors is the number of distinct colors auto-color picks from.
+const autoColors = 12
 
-				i.connectRealize(windowBox)
-				i.connectButtonPress(windowBox, window)
-				i.connectTooltip(windowBox, window)
-				i.connectHover(windowBox)
-				i.applyWindowRules(windowBox, window, len(column) == 1 || i.config.IconMinSize > 0)
+// autoColor returns the auto-color palette index for an App ID.
+func autoColor(appId string) int {
+	h := fnv.New32a()
+	h.Write([]byte(appId))
+	return int(h.Sum32() % autoColors)
+}
 
-				colBox.Add(windowBox)
-			}
+// autoColorStylesheet styles the .auto-color-N classes with hues spread evenly
+// around the color wheel. GTK 3 CSS has no hsl(), so they're converted here.
+// It goes before the default stylesheet so .urgent still takes precedence.
+func autoColorStylesheet() string {
+	var css strings.Builder
+	for n := range autoColors {
+		r, g, b := hslToRGB(float64(n)/autoColors, 0.65, 0.6)
+		for _, state := range []struct {
+			selector string
+			alpha    float64
+		}{{"", 0.35}, {":hover", 0.5}, {":active", 0.75}} {
+			fmt.Fprintf(&css, ".cffi-niri-windows .tile.auto-color-%d%s { background-color: rgba(%d, %d, %d, %.2f); }\n",
+				n, state.selector, r, g, b, state.alpha)
+		}
+	}
+	return css.String()
+}
+
+// hslToRGB converts a color with hue, saturation, and lightness in [0, 1] to
+// 8-bit RGB.
+func hslToRGB(h, s, l float64) (r, g, b int) {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h*6, 2)-1))
+	m := l - c/2
+	var rf, gf, bf float64
+	switch int(h * 6) {
+	case 0:
+		rf, gf, bf = c, x, 0
+	case 1:
+		rf, gf, bf = x, c, 0
+	case 2:
+		rf, gf, bf = 0, c, x
+	case 3:
+		rf, gf, bf = 0, x, c
+	case 4:
+		rf, gf, bf = x, 0, c
+	default:
+		rf, gf, bf = c, 0, x
+	}
+	to8 := func(v float64) int { return int(math.Round((v + m) * 255)) }
+	return to8(rf), to8(gf), to8(bf)
+}
+
+// updateTile updates the name, classes, and state of a tile, and reports
+// whether its window is focused.
+func (i *Instance) updateTile(windowBox *gtk.EventBox, window *niri.Window, showIcon bool) (focused bool) {
+	if window.AppId != nil {
+		windowBox.SetName(cssName(*window.AppId))
+	}
+
+	style, _ := windowBox.GetStyleContext()
+	for class, enabled := range i.tileClasses(window) {
+		toggleClass(style, class, enabled)
+	}
+	// invert-emphasis highlights every tile but the focused one
+	if window.IsFocused != i.config.InvertEmphasis {
+		windowBox.SetStateFlags(gtk.STATE_FLAG_ACTIVE, false)
+	} else {
+		windowBox.UnsetStateFlags(gtk.STATE_FLAG_ACTIVE)
+	}
+
+	i.applyWindowRules(windowBox, window, showIcon)
+	return window.IsFocused
+}
+
+// tileClasses returns the state classes of a window's tile, each mapped to
+// whether the tile should have it. Classes stay set until the state clears,
+// e.g. "urgent" until niri reports the urgency is gone.
+func (i *Instance) tileClasses(window *niri.Window) map[string]bool {
+	classes := map[string]bool{
+		"urgent":          window.IsUrgent,
+		"floating-window": window.IsFloating,
+		"active":          i.niriState.IsActiveWindow(window),
+	}
+	color := -1
+	if i.config.AutoColor && window.AppId != nil {
+		color = autoColor(*window.AppId)
+	}
+	for n := range autoColors {
+		classes[fmt.Sprintf("auto-color-%d", n)] = n == color
+	}
+	return classes
+}
 
+// applyCssNames sets css-name and adds css-class to the root widget, so
+// instances can be told apart in CSS.
+func (i *Instance) applyCssNames() {
+	if i.root == nil {
+		return
+	}
+	if name := i.config.CssName; name != "" {
+		if cssName(name) != name {
+			log.Warnf("css-name must be a valid CSS identifier, using %s", cssName(name))
+		}
+		i.root.SetProperty("name", cssName(name))
+	}
+	if class := i.config.CssClass; class != "" {
+		if cssName(class) != class {
+			log.Warnf("css-class must be a valid CSS identifier, using %s", cssName(class))
 		}
+		style, err := i.root.GetStyleContext()
+		if err != nil {
+			log.Errorf("error getting style context: %s", err)
+			return
+		}
+		style.AddClass(cssName(class))
 	}
+}
 
-	if i.config.FloatingPosition == FloatingPositionRight {
-		i.drawFloating(maxWidth, maxHeight, floating, scale)
-		if cols != nil {
-			i.box.ReorderChild(cols, 0)
+// cssName turns an app ID into a valid CSS identifier by replacing any
+// character other than letters, digits, '-', and '_' with '-'.
+func cssName(appId string) string {
+	name := []byte(appId)
+	for idx, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			name[idx] = '-'
 		}
 	}
+	if len(name) == 0 || '0' <= name[0] && name[0] <= '9' {
+		// identifiers can't start with a digit
+		name = append([]byte{'_'}, name...)
+	}
+	return string(name)
+}
+
+// drawText renders the text representation of the workspace into a label,
+// with classes describing its state.
+func (i *Instance) drawText() {
+	options := niri.TextOptions{
+		Symbols:               i.config.Symbols,
+		Separator:             i.config.Separator,
+		SymbolSeparator:       i.config.SymbolSeparator,
+		UrgentStyle:           i.config.UrgentStyle,
+		SpecialWorkspaces:     i.config.SpecialWorkspaces.Regexp,
+		WorkspacePrefixFormat: i.config.WorkspacePrefixFormat,
+		Compact:               i.config.Compact,
+		FloatingCollapse:      i.config.FloatingCollapse,
+		InvertEmphasis:        i.config.InvertEmphasis,
+		Sort:                  i.sortOptions(),
+	}
+	text := i.niriState.Text(i.monitor, options)
+
+	if text == "" {
+		if i.label != nil {
+			i.label.Destroy()
+			i.label = nil
+		}
+		return
+	}
+	if i.label == nil {
+		var err error
+		i.label, err = gtk.LabelNew("")
+		if err != nil {
+			log.Errorf("error creating label: %s", err)
+			return
+		}
+		i.box.Add(i.label)
+		i.label.Show()
+	}
+	if i.config.MaxLength > 0 {
+		i.label.SetMaxWidthChars(i.config.MaxLength)
+		i.label.SetEllipsize(i.config.Ellipsize.PangoMode())
+	} else {
+		i.label.SetMaxWidthChars(-1)
+		i.label.SetEllipsize(pango.ELLIPSIZE_NONE)
+	}
+	// symbols may contain pango markup, and urgent columns are marked up
+	i.label.SetMarkup(text)
+
+	segments, _ := i.niriState.Segments(i.monitor, options)
+	hasClass := func(class string) bool {
+		return slices.ContainsFunc(segments, func(seg niri.Segment) bool { return seg.HasClass(class) })
+	}
+	style, _ := i.label.GetStyleContext()
+	toggleClass(style, "focused", hasClass("focused"))
+	toggleClass(style, "urgent", hasClass("urgent"))
+	toggleClass(style, "empty", len(segments) == 0)
+}
+
+// drawWorkspaces draws a clickable symbol for each workspace on the monitor.
+func (i *Instance) drawWorkspaces() {
+	i.box.GetChildren().Foreach(func(child any) {
+		child.(*gtk.Widget).Destroy()
+	})
+
+	symbols := i.config.Symbols
+	for _, workspace := range i.niriState.Workspaces(i.monitor) {
+		symbol := symbols.WorkspaceEmpty
+		if workspace.IsActive {
+			symbol = symbols.WorkspaceActive
+		} else if workspace.Windows > 0 {
+			symbol = symbols.WorkspaceOccupied
+		}
+
+		workspaceBox, err := gtk.EventBoxNew()
+		if err != nil {
+			log.Errorf("error creating event box: %s", err)
+			return
+		}
+		label, err := gtk.LabelNew("")
+		if err != nil {
+			log.Errorf("error creating label: %s", err)
+			return
+		}
+		label.SetMarkup(symbol)
+		workspaceBox.Add(label)
+
+		style, _ := workspaceBox.GetStyleContext()
+		style.AddClass("workspace")
+		toggleClass(style, "active", workspace.IsActive)
+		toggleClass(style, "focused", workspace.IsFocused)
+		toggleClass(style, "urgent", workspace.IsUrgent)
+		toggleClass(style, "occupied", workspace.Windows > 0)
+		toggleClass(style, "empty", workspace.Windows == 0)
+
+		name := workspace.Name
+		if name == "" {
+			name = strconv.Itoa(int(workspace.Index))
+		}
+		workspaceBox.SetTooltipText(name)
 
+		id := workspace.Id
+		workspaceBox.AddEvents(int(gdk.BUTTON_PRESS_MASK))
+		workspaceBox.Connect("button-press-event", func(obj gtk.IWidget, event *gdk.Event) {
+			if gdk.EventButtonNewFromEvent(event).Button() != gdk.BUTTON_PRIMARY {
+				return
+			}
+			err := i.niriSocket.Request(map[string]any{
+				"Action": map[string]any{
+					"FocusWorkspace": map[string]any{"reference": map[string]any{"Id": id}},
+				},
+			})
+			if err != nil {
+				log.Errorf("error focusing workspace %d: %s", id, err)
+			}
+		})
+		i.connectRealize(workspaceBox)
+
+		i.box.Add(workspaceBox)
+	}
 	i.box.ShowAll()
 }
 
+// isSpecialWorkspace reports whether the displayed workspace matches
+// special-workspaces.
+func (i *Instance) isSpecialWorkspace() bool {
+	if i.config.SpecialWorkspaces.Regexp == nil {
+		return false
+	}
+	workspace, ok := i.niriState.ActiveWorkspace(i.monitor)
+	return ok && workspace.Name != nil && i.config.SpecialWorkspaces.MatchString(*workspace.Name)
+}
+
+// drawWorkspaceLabel creates or updates the label showing the name (or index)
+// of the displayed workspace.
+func (i *Instance) drawWorkspaceLabel() {
+	workspace, ok := i.niriState.ActiveWorkspace(i.monitor)
+	if !ok {
+		if i.workspaceLabel != nil {
+			i.workspaceLabel.Destroy()
+			i.workspaceLabel = nil
+		}
+		return
+	}
+
+	text := strconv.Itoa(int(workspace.Index))
+	if workspace.Name != nil {
+		text = *workspace.Name
+	}
+
+	if i.workspaceLabel == nil {
+		var err error
+		i.workspaceLabel, err = gtk.LabelNew("")
+		if err != nil {
+			log.Errorf("error creating label: %s", err)
+			return
+		}
+		style, _ := i.workspaceLabel.GetStyleContext()
+		style.AddClass("workspace-label")
+		i.box.Add(i.workspaceLabel)
+	}
+	i.workspaceLabel.SetText(text)
+}
+
+// orientations returns the orientation of the top-level box (along which
+// columns are laid out) and of each column (along which its windows stack).
+func (i *Instance) orientations() (outer, column gtk.Orientation) {
+	if i.config.Orientation == OrientationVertical {
+		return gtk.ORIENTATION_VERTICAL, gtk.ORIENTATION_HORIZONTAL
+	}
+	return gtk.ORIENTATION_HORIZONTAL, gtk.ORIENTATION_VERTICAL
+}
+
+// floatingTile is a tile in the floating view, along with the window its
+// signal handlers were connected for.
+type floatingTile struct {
+	box    *gtk.EventBox
+	window *niri.Window
+}
+
+// columnLayout is the computed layout of a column of tiled windows.
+// redistributeWidths divides the total width of the columns between them,
+// either equally or in proportion to how many windows each column has, instead
+// of using the widths of the tiles.
+func redistributeWidths(layouts []columnLayout, mode ColumnWidth) {
+	total, windows := 0, 0
+	for _, layout := range layouts {
+		total += layout.width
+		windows += layout.count
+	}
+	if len(layouts) == 0 || windows == 0 {
+		return
+	}
+	// hand out the width cumulatively so rounding doesn't change the total
+	assigned, seen := 0, 0
+	for idx := range layouts {
+		if mode == ColumnWidthCount {
+			seen += layouts[idx].count
+			end := total * seen / windows
+			layouts[idx].width = end - assigned
+			assigned = end
+		} else {
+			end := total * (idx + 1) / len(layouts)
+			layouts[idx].width = end - assigned
+			assigned = end
+		}
+	}
+}
+
+// barScale returns the factor mapping niri sizes onto a bar of the given
+// height. The allocation and the screen size are both in GTK's logical
+// pixels, which match niri's logical pixels regardless of the scale factor
+// (GTK only renders at ScaleFactor() times that size), so the ratio between
+// them is all that's needed.
+func barScale(barHeight, screenHeight int) float64 {
+	return float64(barHeight) / float64(screenHeight)
+}
+
+// layoutColumn computes the tiles to draw for a column of tiled windows.
+// Called with the state's read lock held.
+func (i *Instance) layoutColumn(column []*niri.Window, scale float64, maxHeight int, viewHeight float64) columnLayout {
+	// whether the column is marked focused doesn't depend on which of its
+	// windows fit into the bar
+	focused := slices.ContainsFunc(column, func(w *niri.Window) bool { return w.IsFocused })
+	active := slices.ContainsFunc(column, i.niriState.IsActiveWindow)
+
+	if i.config.StackThreshold > 0 && len(column) > i.config.StackThreshold {
+		// too many windows to tell apart; show the active one with a count
+		return columnLayout{
+			windows:   []*niri.Window{i.columnActiveWindow(column)},
+			heights:   []int{maxHeight - i.config.ColumnBorders},
+			width:     int(column[0].Layout.TileSize.X * scale),
+			count:     len(column),
+			collapsed: true,
+			focused:   focused,
+			active:    active,
+		}
+	}
+	windowHeights, width, dropped := i.calculateWindowSizes(column, scale, maxHeight-i.config.ColumnBorders, viewHeight)
+	hiddenHeight := 0
+	if dropped > 0 && len(windowHeights) > 1 {
+		// the last window that fit makes way for the "+N" indicator
+		hiddenHeight = windowHeights[len(windowHeights)-1]
+		windowHeights = windowHeights[:len(windowHeights)-1]
+		dropped++
+	}
+	return columnLayout{
+		// windows that didn't fit into the bar were cut
+		windows:      column[:len(windowHeights)],
+		heights:      windowHeights,
+		width:        width,
+		count:        len(column),
+		hidden:       dropped,
+		hiddenHeight: hiddenHeight,
+		single:       len(column) == 1,
+		focused:      focused,
+		active:       active,
+	}
+}
+
+// columnActiveWindow picks the window to show for a collapsed column: the
+// focused window, then the workspace's active window, then the most recently
+// focused one.
+func (i *Instance) columnActiveWindow(column []*niri.Window) *niri.Window {
+	if idx := slices.IndexFunc(column, func(w *niri.Window) bool { return w.IsFocused }); idx >= 0 {
+		return column[idx]
+	}
+	if idx := slices.IndexFunc(column, i.niriState.IsActiveWindow); idx >= 0 {
+		return column[idx]
+	}
+	recent := column[0]
+	for _, window := range column[1:] {
+		if recent.FocusTimestamp.Before(window.FocusTimestamp) {
+			recent = window
+		}
+	}
+	return recent
+}
+
+type columnLayout struct {
+	// windows that fit into the bar, top to bottom
+	windows []*niri.Window
+	// heights of each window in windows
+	heights []int
+	width   int
+	// number of windows in the column, including ones that were cut
+	count int
+	// number of windows that were cut, and the height of the indicator shown
+	// in their place (0 if there was no room for one)
+	hidden       int
+	hiddenHeight int
+	// whether the column has exactly one window
+	single bool
+	// whether the column is drawn as a single tile with a count badge because
+	// it has more windows than stack-threshold
+	collapsed bool
+	// whether the column contains the focused window, even if it was cut
+	focused bool
+	// whether the column contains the workspace's active window
+	active bool
+	// "group-start", "group-mid", or "group-end" if the column is part of a
+	// run of columns of the same app (see group-columns)
+	group string
+}
+
+// tiledLayoutKey identifies the structure of the tiled view. Tiles can be
+// updated in place as long as the key doesn't change.
+func tiledLayoutKey(layouts []columnLayout, overflow int) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "+%d;", overflow)
+	for _, layout := range layouts {
+		fmt.Fprintf(&key, "%d:", layout.count)
+		for _, window := range layout.windows {
+			// pointers change when niri sends a new copy of the window, which
+			// our signal handlers would otherwise hold stale
+			fmt.Fprintf(&key, "%p,", window)
+		}
+		key.WriteByte(';')
+	}
+	return key.String()
+}
+
+// columnApp returns the App ID shared by all windows in the column, or "" if
+// they differ.
+func columnApp(layout columnLayout) string {
+	app := ""
+	for idx, window := range layout.windows {
+		if window.AppId == nil || idx > 0 && *window.AppId != app {
+			return ""
+		}
+		app = *window.AppId
+	}
+	return app
+}
+
+// groupColumns marks runs of adjacent columns of the same app as groups.
+func groupColumns(layouts []columnLayout) {
+	for start := 0; start < len(layouts); {
+		app := columnApp(layouts[start])
+		end := start + 1
+		for app != "" && end < len(layouts) && columnApp(layouts[end]) == app {
+			end++
+		}
+		if end-start > 1 {
+			layouts[start].group = "group-start"
+			for idx := start + 1; idx < end-1; idx++ {
+				layouts[idx].group = "group-mid"
+			}
+			layouts[end-1].group = "group-end"
+		}
+		start = end
+	}
+}
+
+// drawTiled creates the tiled view and the widgets for each column and tile.
+func (i *Instance) drawTiled(layouts []columnLayout, overflow int) {
+	outer, column := i.orientations()
+	i.tiledView, _ = gtk.BoxNew(outer, i.config.Spacing)
+	i.tiledView.SetName(tiledViewName)
+	i.box.Add(i.tiledView)
+
+	i.columnBoxes = make([]*gtk.Box, len(layouts))
+	i.hiddenLabels = make([]*gtk.Label, len(layouts))
+	i.tiles = make(map[uint64]*gtk.EventBox)
+
+	// only the tiles are EventBoxes; the views and column boxes have no input
+	// window of their own, so clicks in the gaps between tiles go to the bar
+	// instead of the nearest tile
+	for idx, layout := range layouts {
+		colBox, _ := gtk.BoxNew(column, i.config.Spacing)
+		colStyle, _ := colBox.GetStyleContext()
+		colStyle.AddClass("column")
+		if layout.single {
+			colStyle.AddClass("single")
+		} else {
+			colStyle.AddClass("stacked")
+		}
+		colStyle.AddClass(fmt.Sprintf("count-%d", layout.count))
+		if layout.collapsed {
+			colStyle.AddClass("collapsed")
+		}
+		i.tiledView.Add(colBox)
+		i.columnBoxes[idx] = colBox
+
+		for _, window := range layout.windows {
+			windowBox, _ := gtk.EventBoxNew()
+			style, _ := windowBox.GetStyleContext()
+			style.AddClass("tile")
+			metrics.TilesCreated.Inc()
+
+			i.connectRealize(windowBox)
+			i.connectButtonPress(windowBox, window)
+			i.connectTooltip(windowBox, window)
+			i.connectHover(windowBox, window)
+			if i.config.TileScrollMove {
+				i.connectScrollMove(windowBox, window)
+			}
+
+			colBox.Add(windowBox)
+			i.tiles[window.Id] = windowBox
+		}
+
+		if layout.hiddenHeight > 0 {
+			label, err := gtk.LabelNew(fmt.Sprintf("+%d", layout.hidden))
+			if err != nil {
+				log.Errorf("error creating label: %s", err)
+				continue
+			}
+			style, _ := label.GetStyleContext()
+			style.AddClass("overflow")
+			colBox.Add(label)
+			i.hiddenLabels[idx] = label
+		}
+	}
+
+	if overflow > 0 {
+		label, err := gtk.LabelNew(fmt.Sprintf("+%d", overflow))
+		if err != nil {
+			log.Errorf("error creating label: %s", err)
+			return
+		}
+		style, _ := label.GetStyleContext()
+		style.AddClass("overflow")
+		i.tiledView.Add(label)
+	}
+}
+
+// fitMaxWidth shrinks columns proportionally so the tiled view fits into
+// max-width. If the columns don't fit even at minimum-size, the columns
+// furthest from the focused column are hidden and their count is returned.
+func (i *Instance) fitMaxWidth(layouts []columnLayout) (fitted []columnLayout, hidden int) {
+	if i.config.MaxWidth <= 0 || len(layouts) == 0 {
+		return layouts, 0
+	}
+
+	totalWidth := func(layouts []columnLayout) int {
+		total := (len(layouts) - 1) * i.config.Spacing
+		for _, layout := range layouts {
+			total += layout.width
+		}
+		return total
+	}
+	if totalWidth(layouts) <= i.config.MaxWidth {
+		return layouts, 0
+	}
+
+	focused := slices.IndexFunc(layouts, func(layout columnLayout) bool { return layout.focused })
+	focused = max(focused, 0)
+
+	// drop columns from whichever end is further from the focused column
+	start, end := 0, len(layouts)
+	for end-start > 1 && (end-start)*i.config.MinimumSize+(end-start-1)*i.config.Spacing > i.config.MaxWidth {
+		if focused-start > end-1-focused {
+			start++
+		} else {
+			end--
+		}
+	}
+	hidden = len(layouts) - (end - start)
+	fitted = slices.Clone(layouts[start:end])
+
+	available := i.config.MaxWidth - (len(fitted)-1)*i.config.Spacing
+	total := totalWidth(fitted) - (len(fitted)-1)*i.config.Spacing
+	if total > available {
+		for idx := range fitted {
+			width := fitted[idx].width * available / total
+			fitted[idx].width = max(i.config.MinimumSize, width)
+		}
+	}
+	return fitted, hidden
+}
+
+// updateColumn updates the sizes, classes, and states of a column's tiles.
+func (i *Instance) updateColumn(col int, layout columnLayout) {
+	colBox := i.columnBoxes[col]
+	for idx, window := range layout.windows {
+		windowBox := i.tiles[window.Id]
+		if i.config.Orientation == OrientationVertical {
+			windowBox.SetSizeRequest(layout.heights[idx], layout.width)
+		} else {
+			windowBox.SetSizeRequest(layout.width, layout.heights[idx])
+		}
+
+		i.updateTile(windowBox, window, layout.single || i.config.IconMinSize > 0)
+		if layout.collapsed {
+			i.drawStackCount(windowBox, layout.count)
+		}
+	}
+	if label := i.hiddenLabels[col]; label != nil {
+		if i.config.Orientation == OrientationVertical {
+			label.SetSizeRequest(layout.hiddenHeight, layout.width)
+		} else {
+			label.SetSizeRequest(layout.width, layout.hiddenHeight)
+		}
+	}
+
+	colStyle, _ := colBox.GetStyleContext()
+	toggleClass(colStyle, "active-column", layout.active)
+	for _, group := range []string{"group-start", "group-mid", "group-end"} {
+		toggleClass(colStyle, group, layout.group == group)
+	}
+
+	if layout.focused {
+		colBox.SetStateFlags(gtk.STATE_FLAG_ACTIVE, false)
+	} else {
+		colBox.UnsetStateFlags(gtk.STATE_FLAG_ACTIVE)
+	}
+}
+
+// drawStackCount replaces the contents of a collapsed column's tile (e.g. a
+// rule icon) with the number of windows in the column.
+func (i *Instance) drawStackCount(windowBox *gtk.EventBox, count int) {
+	windowBox.GetChildren().Foreach(func(child any) {
+		child.(*gtk.Widget).Destroy()
+	})
+	label, err := gtk.LabelNew(strconv.Itoa(count))
+	if err != nil {
+		log.Errorf("error creating label: %s", err)
+		return
+	}
+	style, _ := label.GetStyleContext()
+	style.AddClass("stack-count")
+	windowBox.Add(label)
+}
+
 func (i *Instance) shouldShowFloating(floating []*niri.Window) bool {
 	return i.config.ShowFloating == ShowFloatingAlways || (i.config.ShowFloating == ShowFloatingAuto && len(floating) > 0)
 }
@@ -326,6 +1225,7 @@ func (i *Instance) drawFloating(maxWidth int, maxHeight int, floating []*niri.Wi
 		if i.floatingView != nil {
 			i.floatingView.Destroy()
 			i.floatingView = nil
+			i.floatingTiles = nil
 		}
 		return
 	}
@@ -345,76 +1245,50 @@ func (i *Instance) drawFloating(maxWidth int, maxHeight int, floating []*niri.Wi
 		i.floatingFixed, _ = gtk.FixedNew()
 		i.floatingFixed.SetSizeRequest(maxWidth, maxHeight)
 		i.floatingView.Add(i.floatingFixed)
+		i.floatingTiles = make(map[uint64]floatingTile)
 	}
 
 	hasFocused := false
-
-	existingWindows := make(map[string]struct{})
-	i.floatingFixed.GetChildren().Foreach(func(item any) {
-		windowBox := &gtk.EventBox{Bin: gtk.Bin{Container: gtk.Container{Widget: *item.(*gtk.Widget)}}}
-		id, _ := windowBox.GetName()
-		var window *niri.Window
-		for _, w := range floating {
-			if id == strconv.FormatUint(w.Id, 10) {
-				existingWindows[id] = struct{}{}
-				window = w
-				break
-			}
-		}
-
-		if window == nil {
-			windowBox.Destroy()
-			return
+	seen := make(map[uint64]bool, len(floating))
+	for _, window := range floating {
+		seen[window.Id] = true
+		tile, ok := i.floatingTiles[window.Id]
+		if ok && tile.window != window {
+			// niri sent a new copy of the window, which our signal handlers
+			// don't know about
+			tile.box.Destroy()
+			ok = false
 		}
 
 		x, y, w, h := i.getFloatingLayout(window, scale, maxWidth, maxHeight)
-		i.floatingFixed.Move(windowBox, x, y)
-		windowBox.SetSizeRequest(w, h)
-
-		style, _ := windowBox.GetStyleContext()
-		if window.IsUrgent && !style.HasClass("urgent") {
-			style.AddClass("urgent")
-		} else if !window.IsUrgent && style.HasClass("urgent") {
-			style.RemoveClass("urgent")
-		}
-
-		i.applyWindowRules(windowBox, window, i.config.IconMinSize > 0)
-		if window.IsFocused {
-			windowBox.SetStateFlags(gtk.STATE_FLAG_ACTIVE, false)
-			hasFocused = true
+		if ok {
+			i.floatingFixed.Move(tile.box, x, y)
 		} else {
-			windowBox.UnsetStateFlags(gtk.STATE_FLAG_ACTIVE)
+			windowBox, _ := gtk.EventBoxNew()
+			style, _ := windowBox.GetStyleContext()
+			style.AddClass("tile")
+			metrics.TilesCreated.Inc()
+
+			i.connectRealize(windowBox)
+			i.connectButtonPress(windowBox, window)
+			i.connectTooltip(windowBox, window)
+			i.connectHover(windowBox, window)
+
+			i.floatingFixed.Put(windowBox, x, y)
+			tile = floatingTile{windowBox, window}
+			i.floatingTiles[window.Id] = tile
 		}
-	})
+		tile.box.SetSizeRequest(w, h)
 
-	for _, window := range floating {
-		id := strconv.FormatUint(window.Id, 10)
-		if _, ok := existingWindows[id]; ok {
-			continue
-		}
-
-		windowBox, _ := gtk.EventBoxNew()
-		windowBox.SetName(id)
-
-		style, _ := windowBox.GetStyleContext()
-		style.AddClass("tile")
-		if window.IsUrgent {
-			style.AddClass("urgent")
-		}
-
-		x, y, w, h := i.getFloatingLayout(window, scale, maxWidth, maxHeight)
-		i.floatingFixed.Put(windowBox, x, y)
-		windowBox.SetSizeRequest(w, h)
-		if window.IsFocused {
-			windowBox.SetStateFlags(gtk.STATE_FLAG_ACTIVE, false)
+		if i.updateTile(tile.box, window, i.config.IconMinSize > 0) {
 			hasFocused = true
 		}
-
-		i.connectRealize(windowBox)
-		i.connectButtonPress(windowBox, window)
-		i.connectTooltip(windowBox, window)
-		i.connectHover(windowBox)
-		i.applyWindowRules(windowBox, window, i.config.IconMinSize > 0)
+	}
+	for id, tile := range i.floatingTiles {
+		if !seen[id] {
+			tile.box.Destroy()
+			delete(i.floatingTiles, id)
+		}
 	}
 
 	if hasFocused {
@@ -465,13 +1339,21 @@ func (i *Instance) applyWindowRules(windowBox *gtk.EventBox, window *niri.Window
 	for _, rule := range i.config.WindowRules {
 		appIdMatched := rule.AppId == nil
 		titleMatched := rule.Title == nil
+		workspaceMatched := rule.Workspace == nil
 		if rule.AppId != nil && window.AppId != nil && rule.AppId.MatchString(*window.AppId) {
 			appIdMatched = true
 		}
 		if rule.Title != nil && window.Title != nil && rule.Title.MatchString(*window.Title) {
 			titleMatched = true
 		}
-		if appIdMatched && titleMatched {
+		if rule.Workspace != nil && window.WorkspaceId != nil {
+			name, ok := i.niriState.WorkspaceName(*window.WorkspaceId)
+			if ok && rule.Workspace.MatchString(name) {
+				workspaceMatched = true
+			}
+		}
+		floatingMatched := rule.Floating.Matches(window.IsFloating)
+		if appIdMatched && titleMatched && workspaceMatched && floatingMatched {
 			style.AddClass(rule.Class)
 
 			w, h := windowBox.ToWidget().GetSizeRequest()
@@ -494,25 +1376,43 @@ func (i *Instance) applyWindowRules(windowBox *gtk.EventBox, window *niri.Window
 	}
 }
 
-func (*Instance) connectRealize(windowBox gtk.IWidget) {
+// connectRealize sets the tile-cursor on the widget once it has a window.
+func (i *Instance) connectRealize(windowBox gtk.IWidget) {
+	name := i.config.TileCursor
+	if name == "" {
+		return
+	}
 	windowBox.ToWidget().Connect("realize", func(obj gtk.IWidget) {
 		gdkWindow, _ := windowBox.ToWidget().GetWindow()
 		display, _ := windowBox.ToWidget().GetDisplay()
-		pointer, _ := gdk.CursorNewFromName(display, "pointer")
-		gdkWindow.SetCursor(pointer)
+		cursor, err := gdk.CursorNewFromName(display, name)
+		if err != nil {
+			log.Warnf("unknown tile-cursor %s: %s", name, err)
+			return
+		}
+		gdkWindow.SetCursor(cursor)
 	})
 }
 
-func (*Instance) connectTooltip(windowBox gtk.IWidget, window *niri.Window) {
+func (i *Instance) connectTooltip(windowBox gtk.IWidget, window *niri.Window) {
 	windowBox.ToWidget().SetProperty("has-tooltip", true)
 	windowBox.ToWidget().Connect("query-tooltip", func(obj gtk.IWidget, x, y int, keyboardTip bool, tooltip *gtk.Tooltip) bool {
+		if i.config.TooltipFormat != "" {
+			text := formatTooltip(i.config.TooltipFormat, window, i.config.AppAliases)
+			if strings.TrimSpace(text) == "" {
+				return false
+			}
+			tooltip.SetText(text)
+			return true
+		}
+
 		if window.Title != nil {
 			tooltip.SetText(*window.Title)
 			return true
 		}
 
 		if window.AppId != nil {
-			tooltip.SetText(*window.AppId)
+			tooltip.SetText(i.config.AppAliases.Name(*window.AppId))
 			return true
 		}
 
@@ -520,70 +1420,344 @@ func (*Instance) connectTooltip(windowBox gtk.IWidget, window *niri.Window) {
 	})
 }
 
-func (*Instance) connectHover(windowBox gtk.IWidget) {
+// formatTooltip replaces the {title}, {app_id}, {app_name}, {id}, {pid}, and
+// {focused_ago} placeholders in format. {app_name} is the App ID after
+// applying aliases. Unknown values are replaced with an empty string.
+func formatTooltip(format string, window *niri.Window, aliases AppAliases) string {
+	var title, appId, appName, pid string
+	if window.Title != nil {
+		title = *window.Title
+	}
+	if window.AppId != nil {
+		appId = *window.AppId
+		appName = aliases.Name(appId)
+	}
+	if window.Pid != nil {
+		pid = strconv.Itoa(int(*window.Pid))
+	}
+	focusedAgo := "never"
+	if window.FocusTimestamp != nil {
+		now, err := niri.Now()
+		if err != nil {
+			log.Errorf("error getting time: %s", err)
+			focusedAgo = ""
+		} else {
+			focusedAgo = formatAge(now.Sub(*window.FocusTimestamp)) + " ago"
+		}
+	}
+	return strings.NewReplacer(
+		"{title}", title,
+		"{app_id}", appId,
+		"{app_name}", appName,
+		"{id}", strconv.FormatUint(window.Id, 10),
+		"{pid}", pid,
+		"{focused_ago}", focusedAgo,
+	).Replace(format)
+}
+
+// formatAge formats a duration in its largest whole unit, e.g. "3m".
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", max(int(d.Seconds()), 0))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+func (i *Instance) connectHover(windowBox gtk.IWidget, window *niri.Window) {
 	windowBox.ToWidget().AddEvents(int(gdk.POINTER_MOTION_MASK | gdk.ENTER_NOTIFY_MASK | gdk.LEAVE_NOTIFY_MASK))
 
 	windowBox.ToWidget().Connect("enter-notify-event", func(obj gtk.IWidget, event *gdk.Event) {
 		windowBox.ToWidget().SetStateFlags(gtk.STATE_FLAG_PRELIGHT, false)
+		if i.config.FocusOnHover {
+			i.cancelHoverFocus()
+			i.hoverTimer = glib.TimeoutAdd(uint(i.config.FocusOnHoverDelay), func() bool {
+				i.hoverTimer = 0
+				err := i.niriSocket.Request(windowAction("FocusWindow", window.Id))
+				if err != nil {
+					log.Errorf("error focusing window %d: %s", window.Id, err)
+				}
+				return false
+			})
+		}
 	})
 	windowBox.ToWidget().Connect("leave-notify-event", func(obj gtk.IWidget, event *gdk.Event) {
 		windowBox.ToWidget().UnsetStateFlags(gtk.STATE_FLAG_PRELIGHT)
+		i.cancelHoverFocus()
 	})
 }
 
+// cancelHoverFocus cancels focusing a hovered window, if it's pending.
+func (i *Instance) cancelHoverFocus() {
+	if i.hoverTimer != 0 {
+		glib.SourceRemove(i.hoverTimer)
+		i.hoverTimer = 0
+	}
+}
+
+// killProcessAction is a pseudo-action for on-tile-*-click that sends SIGTERM
+// to the window's process directly instead of asking niri to close it.
+const killProcessAction = "kill-process"
+
 func (i *Instance) connectButtonPress(windowBox gtk.IWidget, window *niri.Window) {
 	windowBox.ToWidget().AddEvents(int(gdk.BUTTON_PRESS_MASK))
 
 	windowBox.ToWidget().Connect("button-press-event", func(obj gtk.IWidget, event *gdk.Event) {
 		eventButton := gdk.EventButtonNewFromEvent(event)
-		var request map[string]any
-		switch eventButton.Button() {
-		case gdk.BUTTON_PRIMARY:
-			if i.config.OnTileClick != "" {
-				request = map[string]any{
-					"Action": map[string]any{
-						i.config.OnTileClick: map[string]any{"id": window.Id},
-					},
-				}
+		action := i.tileAction(eventButton)
+		if action == "" {
+			return
+		}
+
+		if action == contextMenuAction {
+			i.showContextMenu(event, window)
+			return
+		}
+
+		if action == focusColumnAction {
+			i.focusColumn(window)
+			return
+		}
+
+		if action == killProcessAction {
+			err := killProcess(window)
+			if err != nil {
+				log.Errorf("error killing process of window %d: %s", window.Id, err)
 			}
-		case gdk.BUTTON_MIDDLE:
-			if i.config.OnTileMiddleClick != "" {
-				request = map[string]any{
-					"Action": map[string]any{
-						i.config.OnTileMiddleClick: map[string]any{"id": window.Id},
-					},
-				}
+			return
+		}
+
+		if action.IsCustom() {
+			request, err := action.Request(window.Id)
+			if err != nil {
+				log.Errorf("error building action for window %d: %s", window.Id, err)
+				return
 			}
-		case gdk.BUTTON_SECONDARY:
-			if i.config.OnTileRightClick != "" {
-				request = map[string]any{
-					"Action": map[string]any{
-						i.config.OnTileRightClick: map[string]any{"id": window.Id},
-					},
-				}
+			err = i.niriSocket.Request(request)
+			if err != nil {
+				log.Errorf("error sending action for window %d: %s", window.Id, err)
 			}
+			return
+		}
+
+		err := i.niriSocket.Request(windowAction(string(action), window.Id))
+		if err != nil {
+			log.Errorf("error sending action for window %d: %s", window.Id, err)
+		}
+	})
+}
+
+// tileAction returns the action for a button press on a tile. tile-bindings
+// take precedence over the on-tile-*-click options.
+func (i *Instance) tileAction(eventButton *gdk.EventButton) TileAction {
+	state := gdk.ModifierType(eventButton.State())
+	if action, ok := i.config.TileBindings.Action(state, uint(eventButton.Button())); ok {
+		return action
+	}
+	switch eventButton.Button() {
+	case gdk.BUTTON_PRIMARY:
+		if state&gdk.SHIFT_MASK != 0 {
+			return i.config.OnTileShiftClick
 		}
-		if request == nil {
+		return i.config.OnTileClick
+	case gdk.BUTTON_MIDDLE:
+		return i.config.OnTileMiddleClick
+	case gdk.BUTTON_SECONDARY:
+		return i.config.OnTileRightClick
+	}
+	return ""
+}
+
+// focusColumnAction is a pseudo-action for on-tile-*-click that focuses the
+// window's column rather than the window itself, e.g. to keep the active tab
+// of a tabbed column.
+const focusColumnAction = "focus-column"
+
+func (i *Instance) focusColumn(window *niri.Window) {
+	pos := window.Layout.PosInScrollingLayout
+	if pos == nil {
+		// floating windows have no column
+		return
+	}
+	// FocusColumn acts on the focused output
+	requests := i.focusMonitorRequests(i.monitor)
+	requests = append(requests, map[string]any{
+		"Action": map[string]any{
+			"FocusColumn": map[string]any{"index": pos.X},
+		},
+	})
+	err := i.niriSocket.RequestBatch(requests)
+	if err != nil {
+		log.Errorf("error focusing column of window %d: %s", window.Id, err)
+	}
+}
+
+// contextMenuAction is a pseudo-action for on-tile-*-click that pops up a
+// menu of common actions for the window.
+const contextMenuAction = "context-menu"
+
+var contextMenuItems = []struct{ label, action string }{
+	{"Focus", "FocusWindow"},
+	{"Close", "CloseWindow"},
+	{"Toggle Floating", "ToggleWindowFloating"},
+	{"Fullscreen", "FullscreenWindow"},
+}
+
+func (i *Instance) showContextMenu(event *gdk.Event, window *niri.Window) {
+	menu, err := gtk.MenuNew()
+	if err != nil {
+		log.Errorf("error creating menu: %s", err)
+		return
+	}
+	for _, item := range contextMenuItems {
+		menuItem, err := gtk.MenuItemNewWithLabel(item.label)
+		if err != nil {
+			log.Errorf("error creating menu item: %s", err)
 			return
 		}
+		menuItem.Connect("activate", func() {
+			err := i.niriSocket.Request(windowAction(item.action, window.Id))
+			if err != nil {
+				log.Errorf("error sending action for window %d: %s", window.Id, err)
+			}
+		})
+		menu.Append(menuItem)
+	}
+	menu.ShowAll()
+
+	// keep a reference to the menu while it's shown
+	if i.contextMenu != nil {
+		i.contextMenu.Destroy()
+	}
+	i.contextMenu = menu
+	menu.PopupAtPointer(event)
+}
+
+// killProcess sends SIGTERM to the process that owns window.
+func killProcess(window *niri.Window) error {
+	if window.Pid == nil {
+		return fmt.Errorf("window has no known PID")
+	}
+	process, err := os.FindProcess(int(*window.Pid))
+	if err != nil {
+		return err
+	}
+	log.Infof("sending SIGTERM to pid %d (window %d)", *window.Pid, window.Id)
+	return process.Signal(syscall.SIGTERM)
+}
+
+// connectScrollMove moves a tiled window up or down within its column when
+// scrolling over its tile.
+func (i *Instance) connectScrollMove(windowBox gtk.IWidget, window *niri.Window) {
+	windowBox.ToWidget().AddEvents(int(gdk.SCROLL_MASK | gdk.SMOOTH_SCROLL_MASK))
+
+	windowBox.ToWidget().Connect("scroll-event", func(obj gtk.IWidget, event *gdk.Event) bool {
+		eventScroll := gdk.EventScrollNewFromEvent(event)
+		var action string
+		switch eventScroll.Direction() {
+		case gdk.SCROLL_UP:
+			action = "MoveWindowUp"
+		case gdk.SCROLL_DOWN:
+			action = "MoveWindowDown"
+		case gdk.SCROLL_SMOOTH:
+			if eventScroll.DeltaY() < 0 {
+				action = "MoveWindowUp"
+			} else if eventScroll.DeltaY() > 0 {
+				action = "MoveWindowDown"
+			}
+		}
+		if action == "" {
+			return false
+		}
 
-		err := i.niriSocket.Request(request)
+		// MoveWindowUp/MoveWindowDown act on the focused window
+		requests := []map[string]any{
+			windowAction("FocusWindow", window.Id),
+			{"Action": map[string]any{action: map[string]any{}}},
+		}
+		err := i.niriSocket.RequestBatch(requests)
 		if err != nil {
 			log.Errorf("error sending action: %s", err)
 		}
+		return true
 	})
 }
 
-func (i *Instance) calculateWindowSizes(column []*niri.Window, scale float64, maxHeight int) (windowHeights []int, width int) {
+// onBackgroundScroll switches workspaces or columns when scrolling over the
+// module, depending on bg-scroll. Scrolls handled by a tile don't reach it.
+func (i *Instance) onBackgroundScroll(obj gtk.IWidget, event *gdk.Event) bool {
+	i.mu.RLock()
+	mode := i.config.BgScroll
+	monitor := i.monitor
+	i.mu.RUnlock()
+
+	var prev, next string
+	switch mode {
+	case BgScrollWorkspace:
+		prev, next = "FocusWorkspaceUp", "FocusWorkspaceDown"
+	case BgScrollColumn:
+		prev, next = "FocusColumnLeft", "FocusColumnRight"
+	default:
+		return false
+	}
+
+	eventScroll := gdk.EventScrollNewFromEvent(event)
+	var action string
+	switch eventScroll.Direction() {
+	case gdk.SCROLL_UP:
+		action = prev
+	case gdk.SCROLL_DOWN:
+		action = next
+	case gdk.SCROLL_SMOOTH:
+		if eventScroll.DeltaY() < 0 {
+			action = prev
+		} else if eventScroll.DeltaY() > 0 {
+			action = next
+		}
+	}
+	if action == "" {
+		return false
+	}
+
+	// the focus actions act on the focused output, so focus this one first
+	requests := i.focusMonitorRequests(monitor)
+	requests = append(requests, map[string]any{"Action": map[string]any{action: map[string]any{}}})
+	err := i.niriSocket.RequestBatch(requests)
+	if err != nil {
+		log.Errorf("error sending action: %s", err)
+	}
+	return true
+}
+
+// workspaceViewHeight derives the height of the workspace view from the extent
+// of the tiled windows that have a known position. It returns 0 if no tiled
+// window has a position.
+func workspaceViewHeight(tiled []*niri.Window) float64 {
+	var height float64
+	for _, window := range tiled {
+		pos := window.Layout.TilePosInWorkspaceView
+		if pos == nil {
+			continue
+		}
+		height = max(height, pos.Y+window.Layout.TileSize.Y)
+	}
+	return height
+}
+
+func (i *Instance) calculateWindowSizes(column []*niri.Window, scale float64, maxHeight int, viewHeight float64) (windowHeights []int, width int, dropped int) {
 	// called when read-lock is held, no need to re-lock
 
 	if len(column) == 1 {
-		screenHeight := float64(i.screenHeight) * screenHeightScale
 		height := min(
-			int(math.Round(float64(column[0].Layout.TileSize.Y)/screenHeight*float64(maxHeight))),
+			int(math.Round(float64(column[0].Layout.TileSize.Y)/viewHeight*float64(maxHeight))),
 			maxHeight,
 		)
-		return []int{height}, int(column[0].Layout.TileSize.X * scale)
+		return []int{height}, int(column[0].Layout.TileSize.X * scale), 0
 	}
 
 	var totalTileHeight float64
@@ -593,22 +1767,23 @@ func (i *Instance) calculateWindowSizes(column []*niri.Window, scale float64, ma
 	}
 	totalWindowHeight := 0
 	maxHeight = maxHeight - (len(column)-1)*i.config.Spacing // remove spacing between each window
-	for _, window := range column {
-		height := max(
-			int(math.Round(float64(maxHeight)*(window.Layout.TileSize.Y/totalTileHeight))),
-			i.config.MinimumSize,
-		)
+	// each window's exact share of the height; rounding errors are corrected
+	// against these so the result only depends on the tile sizes
+	shares := make([]float64, len(column))
+	for idx, window := range column {
+		shares[idx] = float64(maxHeight) * (window.Layout.TileSize.Y / totalTileHeight)
+		height := max(int(shares[idx]), i.config.MinimumSize)
 		totalWindowHeight += height
 		windowHeights = append(windowHeights, height)
 	}
 	remainingHeight := maxHeight - totalWindowHeight
-	idx := 0
 	iterations := 0
 outer:
 	for remainingHeight < 0 {
 		inner := 0
 		for remainingHeight < 0 {
-			if windowHeights[idx] > i.config.MinimumSize {
+			// take from the window furthest above its share
+			if idx := mostOverShare(windowHeights, shares, i.config.MinimumSize); idx >= 0 {
 				windowHeights[idx]--
 				remainingHeight++
 			} else {
@@ -631,18 +1806,12 @@ outer:
 				log.Warnf("bar too small, dropping window from display (column has %d windows); decrease minimum-size or spacing to fit more", len(windowHeights))
 				h := windowHeights[len(windowHeights)-1]
 				windowHeights = windowHeights[:len(windowHeights)-1]
+				shares = shares[:len(shares)-1]
+				dropped++
 				remainingHeight += i.config.Spacing // account for removed gap
 				remainingHeight += h                // account for removed window
-				// reset idx if needed
-				if idx >= len(windowHeights) {
-					idx = 0
-				}
 				break
 			}
-			idx++
-			if idx >= len(windowHeights) {
-				idx = 0
-			}
 		}
 
 		iterations++
@@ -652,19 +1821,81 @@ outer:
 		}
 	}
 	for remainingHeight > 0 {
+		// give to the window furthest below its share, so leftover pixels go
+		// to the windows that lost the most to rounding
+		idx := leastOverShare(windowHeights, shares)
 		windowHeights[idx]++
 		remainingHeight--
-		idx++
-		if idx >= len(windowHeights) {
-			idx = 0
+	}
+
+	return windowHeights, width, dropped
+}
+
+// mostOverShare returns the index of the window whose height is furthest
+// above its share of the column, among windows taller than minimum, or -1 if
+// there are none. Ties go to the lowest index.
+func mostOverShare(heights []int, shares []float64, minimum int) int {
+	best := -1
+	for idx, height := range heights {
+		if height <= minimum {
+			continue
+		}
+		if best == -1 || float64(height)-shares[idx] > float64(heights[best])-shares[best] {
+			best = idx
 		}
 	}
+	return best
+}
 
-	return windowHeights, width
+// leastOverShare returns the index of the window whose height is furthest
+// below its share of the column. Ties go to the window closest to the middle
+// of the column, then the lowest index, so equal windows grow from the center.
+func leastOverShare(heights []int, shares []float64) int {
+	fromCenter := func(idx int) int {
+		return max(2*idx-(len(heights)-1), (len(heights)-1)-2*idx)
+	}
+	best := 0
+	for idx, height := range heights {
+		over, bestOver := float64(height)-shares[idx], float64(heights[best])-shares[best]
+		if over < bestOver || (over == bestOver && fromCenter(idx) < fromCenter(best)) {
+			best = idx
+		}
+	}
+	return best
 }
 
+// Refresh is called when Waybar receives SIGRTMIN+signal.
 func (i *Instance) Refresh(signal int) {
-	// we don't respond to signals
+	i.mu.Lock()
+	if i.config.StatusSignal != 0 && signal == i.config.StatusSignal {
+		log.Infof("status: instance %x: monitor=%q ready=%t visible=%t mode=%s rules=%d",
+			i.id, i.monitor, i.ready, i.visible, i.config.Mode, len(i.config.WindowRules))
+		i.mu.Unlock()
+		log.Infof("status: niri: %s", i.niriState.Status())
+		return
+	}
+	if i.config.MetricsSignal != 0 && signal == i.config.MetricsSignal {
+		i.mu.Unlock()
+		var b strings.Builder
+		metrics.Write(&b)
+		log.Infof("metrics:\n%s", b.String())
+		return
+	}
+	if i.signal == 0 || signal != i.signal || i.config.RulesFile == "" {
+		i.mu.Unlock()
+		return
+	}
+	rules, err := loadRulesFile(i.config.RulesFile)
+	if err != nil {
+		i.mu.Unlock()
+		log.Errorf("error reloading rules: %s", err)
+		return
+	}
+	i.config.WindowRules = rules
+	log.Infof("reloaded %d rules from %s", len(rules), i.config.RulesFile)
+	i.mu.Unlock()
+
+	i.Notify()
 }
 
 func (i *Instance) DoAction(actionName string) {
@@ -675,17 +1906,128 @@ func (i *Instance) DoAction(actionName string) {
 		return
 	}
 
-	request := map[string]any{
-		"Action": map[string]any{
-			actionName: map[string]any{},
-		},
+	var requests []map[string]any
+	switch actionName {
+	case "focus-mru":
+		window := i.mostRecentlyUsedWindow()
+		if window == nil {
+			return
+		}
+		requests = append(requests, windowAction("FocusWindow", window.Id))
+	case "focus-first", "focus-last":
+		tiled, _ := i.niriState.Windows(i.monitor, i.sortOptions())
+		if len(tiled) == 0 {
+			return
+		}
+		// tiled windows are sorted by column, then by column-sort
+		window := tiled[0]
+		if actionName == "focus-last" {
+			last := tiled[len(tiled)-1].Layout.PosInScrollingLayout.X
+			idx := slices.IndexFunc(tiled, func(w *niri.Window) bool {
+				return w.Layout.PosInScrollingLayout.X == last
+			})
+			window = tiled[idx]
+		}
+		requests = append(requests, windowAction("FocusWindow", window.Id))
+	case "close-all-on-workspace":
+		tiled, floating := i.niriState.Windows(i.monitor, i.sortOptions())
+		for _, window := range slices.Concat(tiled, floating) {
+			requests = append(requests, windowAction("CloseWindow", window.Id))
+		}
+	default:
+		if index, ok := strings.CutPrefix(actionName, "focus-column-"); ok {
+			column, err := strconv.Atoi(index)
+			if err != nil {
+				log.Errorf("invalid action %s: %s", actionName, err)
+				return
+			}
+			tiled, _ := i.niriState.Windows(i.monitor, i.sortOptions())
+			maxColumn := 0
+			for _, window := range tiled {
+				maxColumn = max(maxColumn, int(window.Layout.PosInScrollingLayout.X))
+			}
+			if column < 1 || column > maxColumn {
+				log.Debugf("%s: no such column (workspace has %d columns)", actionName, maxColumn)
+				return
+			}
+			// FocusColumn acts on the focused output
+			requests = i.focusMonitorRequests(i.monitor)
+			requests = append(requests, map[string]any{
+				"Action": map[string]any{
+					"FocusColumn": map[string]any{"index": column},
+				},
+			})
+			break
+		}
+		requests = append(requests, map[string]any{
+			"Action": map[string]any{
+				actionName: map[string]any{},
+			},
+		})
 	}
-	err := i.niriSocket.Request(request)
+	err := i.niriSocket.RequestBatch(requests)
 	if err != nil {
 		log.Errorf("error sending action: %s", err)
 	}
 }
 
+// focusMonitorRequests returns the requests needed to focus the given monitor
+// before sending an action that acts on the focused output.
+func (i *Instance) focusMonitorRequests(monitor string) []map[string]any {
+	if monitor == "" || i.niriState.FocusedOutput() == monitor {
+		return nil
+	}
+	return []map[string]any{{
+		"Action": map[string]any{
+			"FocusMonitor": map[string]any{"output": monitor},
+		},
+	}}
+}
+
+// windowAction builds a request for a niri action that takes a single window
+// id.
+func windowAction(action string, id uint64) map[string]any {
+	return map[string]any{
+		"Action": map[string]any{
+			action: map[string]any{"id": id},
+		},
+	}
+}
+
+// mostRecentlyUsedWindow returns the most recently focused window on this
+// instance's workspace, excluding the currently focused window.
+func (i *Instance) mostRecentlyUsedWindow() *niri.Window {
+	tiled, floating := i.niriState.Windows(i.monitor, i.sortOptions())
+	var mru *niri.Window
+	for _, window := range slices.Concat(tiled, floating) {
+		if window.IsFocused || window.FocusTimestamp == nil {
+			continue
+		}
+		if mru == nil || mru.FocusTimestamp.Before(window.FocusTimestamp) {
+			mru = window
+		}
+	}
+	return mru
+}
+
+func (i *Instance) sortOptions() niri.SortOptions {
+	return niri.SortOptions{
+		Floating: i.config.FloatingSort,
+		Column:   i.config.ColumnSort,
+		// never drawn, so don't act on them either
+		HideFloating: i.config.ShowFloating == ShowFloatingNever,
+	}
+}
+
+// toggleClass adds or removes a CSS class depending on enabled.
+func toggleClass(style *gtk.StyleContext, class string, enabled bool) {
+	if enabled && !style.HasClass(class) {
+		style.AddClass(class)
+	} else if !enabled && style.HasClass(class) {
+		style.RemoveClass(class)
+	}
+}
+
 func groupBy[T any, K comparable](list []T, key func(T) K) [][]T {
 	m := make(map[K][]T)
 	for _, item := range list {
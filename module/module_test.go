@@ -0,0 +1,294 @@
+package module
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"wnw/niri"
+)
+
+func tiledWindow(id, workspace uint64, col, row uint32, height float64) niri.Window {
+	return niri.Window{
+		Id:          id,
+		WorkspaceId: &workspace,
+		Layout: niri.WindowLayout{
+			PosInScrollingLayout: &niri.Vec2[uint32]{X: col, Y: row},
+			TileSize:             niri.Vec2[float64]{X: 960, Y: height},
+		},
+	}
+}
+
+// newTestInstance returns an instance on a 1920x1080 screen whose state has
+// workspace 1 focused on DP-1 and the given windows.
+func newTestInstance(windows ...niri.Window) *Instance {
+	state := niri.NewNiriState()
+	output := "DP-1"
+	state.Update(&niri.WorkspacesChanged{Workspaces: []*niri.Workspace{
+		{Id: 1, Index: 1, Output: &output, IsActive: true, IsFocused: true},
+	}})
+	state.Update(&niri.WindowsChanged{Windows: windows})
+	i := New(state, niri.Socket{}, func() {})
+	i.monitor = output
+	i.screenWidth = 1920
+	i.screenHeight = 1080
+	return i
+}
+
+func column(i *Instance) []*niri.Window {
+	tiled, _ := i.niriState.Windows(i.monitor, i.sortOptions())
+	return tiled
+}
+
+func TestLayoutColumnFocusedWhenCut(t *testing.T) {
+	var windows []niri.Window
+	for row := range uint32(6) {
+		windows = append(windows, tiledWindow(uint64(row+1), 1, 1, row+1, 180))
+	}
+	// the bottom window has focus but won't fit into a short bar
+	windows[5].IsFocused = true
+	i := newTestInstance(windows...)
+	i.config.MinimumSize = 4
+
+	tests := []struct {
+		name      string
+		maxHeight int
+		cut       bool
+	}{
+		{"tall bar", 60, false},
+		{"short bar", 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scale := float64(tt.maxHeight) / float64(i.screenHeight)
+			layout := i.layoutColumn(column(i), scale, tt.maxHeight, 1080)
+			if cut := len(layout.windows) < 6; cut != tt.cut {
+				t.Fatalf("%d of 6 windows fit, want cut = %t", len(layout.windows), tt.cut)
+			}
+			if !layout.focused {
+				t.Error("column with the focused window isn't marked focused")
+			}
+		})
+	}
+
+	// and a column without the focused window never is
+	windows[5].IsFocused = false
+	i = newTestInstance(windows...)
+	if layout := i.layoutColumn(column(i), 8.0/1080, 8, 1080); layout.focused {
+		t.Error("column without a focused window is marked focused")
+	}
+}
+
+const commentedRules = `[
+	// terminals get an icon
+	{ "app-id": "^(foot|kitty)$", "icon": "terminal" },
+	/* browsers, whatever the title says */
+	{
+		"app-id": "firefox", // matched case-insensitively
+		"ignore-case": true,
+		"class": "browser",
+	},
+]`
+
+func TestCommentedRules(t *testing.T) {
+	check := func(t *testing.T, rules WindowRules) {
+		t.Helper()
+		if len(rules) != 2 {
+			t.Fatalf("got %d rules, want 2", len(rules))
+		}
+		if rules[0].Icon != "terminal" || !rules[0].AppId.MatchString("foot") {
+			t.Errorf("rule 0 = %+v", rules[0])
+		}
+		if rules[1].Class != "browser" || !rules[1].AppId.MatchString("Firefox") {
+			t.Errorf("rule 1 = %+v", rules[1])
+		}
+	}
+
+	t.Run("config", func(t *testing.T) {
+		i := newTestInstance()
+		err := i.ApplyConfig("config", `{
+			// per-app styling
+			"rules": `+commentedRules+`,
+		}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, i.config.WindowRules)
+	})
+
+	t.Run("rules-file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rules.jsonc")
+		if err := os.WriteFile(path, []byte(commentedRules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := loadRulesFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, rules)
+	})
+}
+
+func TestTileUrgentClass(t *testing.T) {
+	i := newTestInstance(tiledWindow(1, 1, 1, 1, 1080), tiledWindow(2, 1, 2, 1, 1080))
+	urgent := func() (classes []bool) {
+		for _, window := range column(i) {
+			classes = append(classes, i.tileClasses(window)["urgent"])
+		}
+		return classes
+	}
+
+	focus := uint64(1)
+	tests := []struct {
+		event niri.Event
+		want  []bool
+	}{
+		{&niri.WindowUrgencyChanged{Id: 2, Urgent: true}, []bool{false, true}},
+		// unrelated events keep the class
+		{&niri.WindowFocusChanged{Id: &focus}, []bool{false, true}},
+		{&niri.WindowUrgencyChanged{Id: 1, Urgent: true}, []bool{true, true}},
+		{&niri.WindowUrgencyChanged{Id: 2, Urgent: false}, []bool{true, false}},
+		{&niri.WindowUrgencyChanged{Id: 1, Urgent: false}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		i.niriState.Update(tt.event)
+		if got := urgent(); !slices.Equal(got, tt.want) {
+			t.Errorf("after %T: urgent = %v, want %v", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateWindowSizes(t *testing.T) {
+	tests := []struct {
+		name      string
+		tiles     []float64
+		maxHeight int
+		want      []int
+	}{
+		{"even split", []float64{360, 360, 360}, 32, []int{10, 10, 10}},
+		// leftover pixels go to the middle, not the top
+		{"one leftover", []float64{360, 360, 360}, 33, []int{10, 11, 10}},
+		{"two leftover", []float64{270, 270, 270, 270}, 25, []int{5, 6, 6, 5}},
+		// and to the windows that lost the most to rounding
+		{"proportional", []float64{720, 360}, 31, []int{20, 10}},
+		{"uneven", []float64{540, 270, 270}, 23, []int{11, 5, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var windows []niri.Window
+			for idx, height := range tt.tiles {
+				windows = append(windows, tiledWindow(uint64(idx+1), 1, 1, uint32(idx+1), height))
+			}
+			i := newTestInstance(windows...)
+			scale := float64(tt.maxHeight) / float64(i.screenHeight)
+
+			heights, _, dropped := i.calculateWindowSizes(column(i), scale, tt.maxHeight, 1080)
+			if dropped != 0 {
+				t.Fatalf("dropped %d windows", dropped)
+			}
+			total := (len(heights) - 1) * i.config.Spacing
+			for _, height := range heights {
+				total += height
+			}
+			if total != tt.maxHeight {
+				t.Errorf("heights %v and spacing add up to %d, want %d", heights, total, tt.maxHeight)
+			}
+			if !slices.Equal(heights, tt.want) {
+				t.Errorf("heights = %v, want %v", heights, tt.want)
+			}
+			for range 3 {
+				again, _, _ := i.calculateWindowSizes(column(i), scale, tt.maxHeight, 1080)
+				if !slices.Equal(again, heights) {
+					t.Fatalf("heights changed between identical calls: %v, then %v", heights, again)
+				}
+			}
+		})
+	}
+}
+
+// TestBarScale documents that the tile math only uses logical pixels: a
+// 3840x2160 output at scale 2 is 1920x1080 to both niri and GTK, and draws
+// exactly like a 1920x1080 output at scale 1.
+func TestBarScale(t *testing.T) {
+	// GTK and niri both work in logical pixels, the physical size divided by
+	// the output scale. Whatever the scale, a tile should cover the same share
+	// of the bar's physical pixels as the window does of the screen's.
+	tests := []struct {
+		name                      string
+		screenWidth, screenHeight int // physical size of the output
+		barHeight                 int // physical height of the bar
+		outputScale               float64
+	}{
+		{"1080p at 1x", 1920, 1080, 24, 1},
+		{"4k at 2x", 3840, 2160, 48, 2},
+		{"4k at 1.5x", 3840, 2160, 48, 1.5},
+		{"1440p at 1.25x", 2560, 1440, 40, 1.25},
+		{"ultrawide at 1x", 3440, 1440, 36, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logical := func(px int) float64 { return float64(px) / tt.outputScale }
+			scale := barScale(int(logical(tt.barHeight)), int(logical(tt.screenHeight)))
+
+			// sizes as drawn, back in physical pixels
+			height := logical(tt.screenHeight) * scale * tt.outputScale
+			width := logical(tt.screenWidth) * scale * tt.outputScale
+			if math.Abs(height-float64(tt.barHeight)) > 0.01 {
+				t.Errorf("full-height tile is %.2f px, want %d", height, tt.barHeight)
+			}
+			want := float64(tt.screenWidth) * float64(tt.barHeight) / float64(tt.screenHeight)
+			if math.Abs(width-want) > 0.01 {
+				t.Errorf("full-width tile is %.2f px, want %.2f", width, want)
+			}
+		})
+	}
+}
+
+func TestShowWhenEmpty(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"off", `{"mode": "text"}`, ""},
+		{"default symbol", `{"mode": "text", "show-when-empty": true}`, defaultEmptySymbol},
+		{"symbols.empty", `{"mode": "text", "show-when-empty": true, "symbols": {"empty": "-"}}`, "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newTestInstance()
+			if err := i.ApplyConfig("config", tt.config); err != nil {
+				t.Fatal(err)
+			}
+			if text := i.niriState.Text(i.monitor, niri.TextOptions{Symbols: i.config.Symbols}); text != tt.want {
+				t.Errorf("Text = %q, want %q", text, tt.want)
+			}
+			// the placeholder is still used when the output has no workspace
+			if text := i.niriState.Text("HDMI-A-1", niri.TextOptions{Symbols: i.config.Symbols}); text != "" {
+				t.Errorf("Text on an unknown output = %q, want the placeholder", text)
+			}
+		})
+	}
+}
+
+func TestInvalidRulesSkipped(t *testing.T) {
+	i := newTestInstance()
+	err := i.ApplyConfig("config", `{
+		"rules": [
+			{ "app-id": "foot", "floating": "sometimes" },
+			{ "app-id": "(", "class": "broken" },
+			{ "app-id": "kitty", "class": "terminal" },
+			"not a rule",
+		],
+		"rules-file": "/nonexistent/rules.jsonc",
+	}`)
+	if err != nil {
+		t.Fatalf("ApplyConfig failed: %s", err)
+	}
+	rules := i.config.WindowRules
+	if len(rules) != 1 || rules[0].Class != "terminal" {
+		t.Errorf("rules = %+v, want only the valid kitty rule", rules)
+	}
+}
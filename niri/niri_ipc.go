@@ -2,6 +2,7 @@ package niri
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,51 +10,357 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"sync"
+	"time"
 	"wnw/log"
+	"wnw/metrics"
 )
 
 type Socket struct {
-	conn net.Conn
+	conn    *requestConn
+	events  *eventStream
+	limiter *rateLimiter
 }
 
+type requestConn struct {
+	mu     sync.Mutex // serializes request/reply roundtrips
+	addr   string
+	conn   net.Conn // nil after a failed roundtrip, until the next request
+	reader *bufio.Reader
+	closed bool
+}
+
+// requestTimeout bounds each write and reply read so a hung niri socket can't
+// freeze the GTK main thread.
+const requestTimeout = time.Second
+
+// Reply is niri's response to a request.
+type Reply struct {
+	Ok  json.RawMessage
+	Err *string
+}
+
+// ErrRateLimited is returned for requests dropped by the rate limiter.
+var ErrRateLimited = errors.New("rate limited")
+
+// identical consecutive requests within this window are dropped
+const dedupeWindow = 25 * time.Millisecond
+
+// rateLimiter is a token bucket per action type, applied while a rate is set,
+// that also always drops identical consecutive requests sent in quick
+// succession.
+type rateLimiter struct {
+	mu            sync.Mutex
+	rate          float64            // the highest of rates, 0 if none
+	rates         map[uint64]float64 // set by each instance sharing the socket
+	buckets       map[string]*bucket
+	lastRequest   string
+	lastRequestAt time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		rates:   make(map[uint64]float64),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow reports whether a request for the given action should be sent.
+func (l *rateLimiter) allow(action string, request []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if string(request) == l.lastRequest && now.Sub(l.lastRequestAt) < dedupeWindow {
+		return false
+	}
+	// deduplicating doesn't depend on a rate being set
+	if l.rate <= 0 {
+		l.lastRequest = string(request)
+		l.lastRequestAt = now
+		return true
+	}
+
+	b, ok := l.buckets[action]
+	if !ok {
+		// allow a short burst of up to one second's worth of requests
+		b = &bucket{tokens: l.rate, last: now}
+		l.buckets[action] = b
+	}
+	b.tokens = min(l.rate, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	l.lastRequest = string(request)
+	l.lastRequestAt = now
+	return true
+}
+
+// SetRateLimit sets the maximum number of requests per second for each action
+// type on behalf of the instance with the given id. The socket is shared, so
+// the highest rate set by any instance applies; a rate of 0 withdraws the
+// instance's rate, and requests aren't limited while no instance sets one.
+func (s *Socket) SetRateLimit(id uint64, rate float64) {
+	l := s.limiter
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate > 0 {
+		l.rates[id] = rate
+	} else {
+		delete(l.rates, id)
+	}
+	effective := 0.0
+	for _, rate := range l.rates {
+		effective = max(effective, rate)
+	}
+	if effective != l.rate {
+		l.rate = effective
+		clear(l.buckets)
+	}
+}
+
+// Request sends a single request. It returns ErrRateLimited if the request
+// was dropped by the rate limiter.
 func (s *Socket) Request(j map[string]any) error {
+	return s.RequestBatch([]map[string]any{j})
+}
+
+// RequestBatch sends requests in order, stopping at the first error. The
+// batch counts as a single request of its last action towards the rate limit,
+// so e.g. focusing an output before an action that acts on the focused
+// output, or closing every window on a workspace, is never cut short.
+func (s *Socket) RequestBatch(requests []map[string]any) error {
+	if len(requests) == 0 {
+		return nil
+	}
+	if s.conn == nil {
+		return fmt.Errorf("socket is nil")
+	}
+	lines := make([][]byte, len(requests))
+	for idx, j := range requests {
+		b, err := json.Marshal(j)
+		if err != nil {
+			return fmt.Errorf("error marshaling request: %w", err)
+		}
+		lines[idx] = b
+	}
+	batch := bytes.Join(lines, []byte(", "))
+	name := requestName(requests[len(requests)-1])
+	if s.limiter != nil && !s.limiter.allow(name, batch) {
+		log.Debugf("niri <- %s (dropped, rate limited)", batch)
+		return fmt.Errorf("%w: %s", ErrRateLimited, name)
+	}
+
+	for _, b := range lines {
+		log.Debugf("niri <- %s", b)
+		_, err := s.conn.roundtrip(append(b, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query sends a request that has no fields (e.g. "Windows") and unmarshals
+// the matching field of niri's reply into v.
+func (s *Socket) query(request string, v any) error {
 	if s.conn == nil {
 		return fmt.Errorf("socket is nil")
 	}
-	b, err := json.Marshal(j)
+	b, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("error marshaling request: %w", err)
 	}
 	log.Debugf("niri <- %s", b)
-	b = append(b, '\n')
-	if _, err := s.conn.Write(b); err != nil {
-		return fmt.Errorf("error writing to niri socket: %w", err)
+	ok, err := s.conn.roundtrip(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	var response map[string]json.RawMessage
+	err = json.Unmarshal(ok, &response)
+	if err != nil {
+		return fmt.Errorf("error unmarshaling %s response: %w", request, err)
+	}
+	field, found := response[request]
+	if !found {
+		return fmt.Errorf("unexpected response to %s: %s", request, ok)
+	}
+	err = json.Unmarshal(field, v)
+	if err != nil {
+		return fmt.Errorf("error unmarshaling %s response: %w", request, err)
 	}
 	return nil
 }
 
-func (s *Socket) logMessages() {
-	go func() {
-		b := bufio.NewReader(s.conn)
-		for {
-			line, err := b.ReadString('\n')
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					log.Debugf("niri connection closed")
-				} else {
-					log.Debugf("error reading from niri socket: %s", err)
-				}
-				return
-			}
+// Resync replaces the workspaces and windows in state with the current ones
+// queried from niri, in case events were missed.
+func (s *Socket) Resync(state *State) error {
+	var workspaces []*Workspace
+	err := s.query("Workspaces", &workspaces)
+	if err != nil {
+		return err
+	}
+	var windows []Window
+	err = s.query("Windows", &windows)
+	if err != nil {
+		return err
+	}
+	metrics.Resyncs.Inc()
+	state.Update(&WorkspacesChanged{Workspaces: workspaces})
+	state.Update(&WindowsChanged{Windows: windows})
+	return nil
+}
 
-			line = line[:len(line)-1]
-			if line == "" {
-				continue
-			}
+// Close closes both connections to niri, which also stops the goroutine
+// reading the event stream.
+func (s *Socket) Close() error {
+	var errs []error
+	if s.events != nil {
+		errs = append(errs, s.events.close())
+	}
+	if s.conn != nil {
+		errs = append(errs, s.conn.close())
+	}
+	return errors.Join(errs...)
+}
 
-			log.Debugf("niri   -> %s", line)
+// OutputSize returns the logical size of the named output.
+func (s *Socket) OutputSize(name string) (width, height int, err error) {
+	var outputs map[string]Output
+	err = s.query("Outputs", &outputs)
+	if err != nil {
+		return
+	}
+	output, ok := outputs[name]
+	if !ok {
+		err = fmt.Errorf("output %s not found", name)
+		return
+	}
+	if output.Logical == nil {
+		err = fmt.Errorf("output %s is disabled", name)
+		return
+	}
+	return int(output.Logical.Width), int(output.Logical.Height), nil
+}
+
+// SetWatchdog reconnects the event stream whenever no events have been
+// received for interval, in case it stalled. niri sends the current windows
+// and workspaces on every new event stream, so this also resyncs the state.
+//
+// The interval is set on behalf of the instance with the given id. The event
+// stream is shared, so the longest interval set by any instance applies; an
+// interval of 0 withdraws the instance's interval, and the watchdog is
+// disabled while no instance sets one. Failed connections are reconnected
+// either way.
+func (s *Socket) SetWatchdog(id uint64, interval time.Duration) {
+	e := s.events
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if interval > 0 {
+		e.intervals[id] = interval
+	} else {
+		delete(e.intervals, id)
+	}
+	timeout := time.Duration(0)
+	for _, interval := range e.intervals {
+		timeout = max(timeout, interval)
+	}
+	e.setTimeout(timeout)
+}
+
+// roundtrip sends a request and reads its reply. If either fails or times
+// out, the connection is closed, since a late reply would be mistaken for the
+// reply to the next request; the next roundtrip connects again.
+func (c *requestConn) roundtrip(b []byte) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if c.conn == nil {
+		conn, err := net.DialTimeout("unix", c.addr, requestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error reconnecting to niri socket: %w", err)
 		}
-	}()
+		log.Debugf("reconnected to niri socket")
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+	}
+
+	line, err := c.send(b)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+		return nil, err
+	}
+	log.Debugf("niri   -> %s", bytes.TrimSpace(line))
+
+	var reply Reply
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return nil, fmt.Errorf("error unmarshaling niri reply: %w", err)
+	}
+	if reply.Err != nil {
+		return nil, fmt.Errorf("niri: %s", *reply.Err)
+	}
+	return reply.Ok, nil
+}
+
+// send writes a request and reads the reply line. Must be called with the
+// lock held.
+func (c *requestConn) send(b []byte) ([]byte, error) {
+	err := c.conn.SetDeadline(time.Now().Add(requestTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("error setting niri socket deadline: %w", err)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		return nil, fmt.Errorf("error writing to niri socket: %w", err)
+	}
+	// niri replies to each request in order, one line per reply
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading from niri socket: %w", err)
+	}
+	return line, nil
+}
+
+func (c *requestConn) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// requestName returns the action name of an Action request, or the request
+// name otherwise.
+func requestName(j map[string]any) string {
+	if action, ok := j["Action"].(map[string]any); ok {
+		for name := range action {
+			return name
+		}
+	}
+	for name := range j {
+		return name
+	}
+	return ""
 }
 
 func Init() (state *State, socket Socket, err error) {
@@ -77,64 +384,288 @@ func Init() (state *State, socket Socket, err error) {
 		err = fmt.Errorf("error connecting to NIRI_SOCKET: %w", err)
 		return
 	}
-	socket = Socket{requestSocket}
-	socket.logMessages()
+	socket = Socket{
+		conn: &requestConn{
+			addr:   socketAddr,
+			conn:   requestSocket,
+			reader: bufio.NewReader(requestSocket),
+		},
+		events:  newEventStream(socketAddr, eventSocket),
+		limiter: newRateLimiter(),
+	}
 	state = NewNiriState()
-	go listen(eventSocket, state)
+	// seed the state before subscribing so the first render doesn't depend on
+	// the order of the event stream's initial snapshot
+	err = socket.Resync(state)
+	if err != nil {
+		log.Warnf("error querying initial state: %s", err)
+		err = nil
+	}
+	go socket.events.run(state)
 
 	return
 }
 
-func listen(socket net.Conn, state *State) {
-	defer socket.Close()
-	if _, err := socket.Write([]byte("\"EventStream\"\n")); err != nil {
-		log.Errorf("error writing to niri socket: %s", err)
-		return
+// maxEventSize is the largest event line accepted from niri. Full snapshots
+// (e.g. WindowsChanged) can be large, but never anywhere near this.
+const maxEventSize = 16 << 20
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a single line, without the trailing newline. Lines longer
+// than max bytes are discarded in full and errLineTooLong is returned, leaving
+// the reader positioned at the start of the next line.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > max+1 {
+				tooLong = true
+				line = nil
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && (len(line) > 0 || tooLong) {
+			// the last line has no trailing newline; EOF is returned next time
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if tooLong {
+		return nil, fmt.Errorf("%w (more than %d bytes)", errLineTooLong, max)
+	}
+	return bytes.TrimSuffix(line, []byte{'\n'}), nil
+}
+
+// eventStream is the EventStream connection. It is reconnected when it fails,
+// or when no events arrive for the watchdog timeout, until it is closed.
+type eventStream struct {
+	mu        sync.Mutex
+	addr      string
+	conn      net.Conn                 // nil while disconnected
+	timeout   time.Duration            // the longest of intervals, 0 if none
+	intervals map[uint64]time.Duration // set by each instance sharing the stream
+	closed    bool
+}
+
+func newEventStream(addr string, conn net.Conn) *eventStream {
+	return &eventStream{
+		addr:      addr,
+		conn:      conn,
+		intervals: make(map[uint64]time.Duration),
 	}
-	b := bufio.NewReader(socket)
+}
+
+// bounds of the delay between attempts to reconnect a failed event stream
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+// run keeps the event stream connected, applying events to state, until the
+// stream is closed.
+func (e *eventStream) run(state *State) {
+	delay := minReconnectDelay
 	for {
-		line, err := b.ReadString('\n')
+		conn, err := e.connect()
+		if conn == nil && err == nil {
+			break // closed
+		}
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				log.Errorf("niri connection closed")
-			} else {
-				log.Errorf("error reading from niri socket: %s", err)
-			}
-			return
+			log.Warnf("error reconnecting to niri socket: %s", err)
+			time.Sleep(delay)
+			delay = min(2*delay, maxReconnectDelay)
+			continue
 		}
 
-		line = line[:len(line)-1]
-		if line == "" {
+		err = e.listen(conn, state)
+		e.mu.Lock()
+		e.conn = nil
+		closed := e.closed
+		timeout := e.timeout
+		e.mu.Unlock()
+		if closed {
+			break
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Debugf("no niri events for %s, reconnecting", timeout)
+			delay = minReconnectDelay
 			continue
 		}
+		state.setConnected(false)
+		if err != nil {
+			log.Errorf("error reading from niri socket: %s", err)
+		} else {
+			log.Errorf("niri connection closed")
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, maxReconnectDelay)
+	}
+	log.Debugf("niri event stream closed")
+	state.setConnected(false)
+}
 
-		niriEvent := new(NiriEvent)
-		err = json.Unmarshal([]byte(line), niriEvent)
+// connect returns the current connection, dialing a new one if there is
+// none. It returns nil and no error once the stream is closed.
+func (e *eventStream) connect() (net.Conn, error) {
+	e.mu.Lock()
+	conn, closed := e.conn, e.closed
+	e.mu.Unlock()
+	if closed || conn != nil {
+		return conn, nil
+	}
+
+	conn, err := net.Dial("unix", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		conn.Close()
+		return nil, nil
+	}
+	e.conn = conn
+	return conn, nil
+}
+
+// listen subscribes to the event stream on conn and applies events to state
+// until the connection fails, times out, or is closed.
+func (e *eventStream) listen(conn net.Conn, state *State) error {
+	defer conn.Close()
+	if _, err := conn.Write([]byte("\"EventStream\"\n")); err != nil {
+		return fmt.Errorf("error writing to niri socket: %w", err)
+	}
+	metrics.Connects.Inc()
+	state.setConnected(true)
+	return readEvents(deadlineReader{conn: conn, stream: e}, state)
+}
+
+// setTimeout must be called with the lock held.
+func (e *eventStream) setTimeout(timeout time.Duration) {
+	e.timeout = timeout
+	if e.conn != nil {
+		// apply to the read in progress, too
+		e.conn.SetReadDeadline(deadline(timeout))
+	}
+}
+
+func (e *eventStream) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	if e.conn == nil {
+		return nil
+	}
+	return e.conn.Close()
+}
+
+// deadlineReader reads from conn, failing with os.ErrDeadlineExceeded if no
+// data arrives within the stream's timeout.
+type deadlineReader struct {
+	conn   net.Conn
+	stream *eventStream
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.stream.mu.Lock()
+	timeout := r.stream.timeout
+	r.stream.mu.Unlock()
+	if err := r.conn.SetReadDeadline(deadline(timeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
+// deadline returns the deadline for a read starting now, or no deadline if
+// timeout is 0.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// ReplayEvents feeds a recorded event stream (one JSON event per line, as
+// sent by niri after an EventStream request) into a new State. This is useful
+// for reproducing bug reports without a running niri instance.
+func ReplayEvents(r io.Reader) (*State, error) {
+	state := NewNiriState()
+	err := readEvents(r, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// readEvents reads events from r and applies them to state until r is
+// exhausted. Malformed events are logged and skipped.
+func readEvents(r io.Reader, state *State) error {
+	b := bufio.NewReader(r)
+	for {
+		line, err := readLine(b, maxEventSize)
+		if errors.Is(err, errLineTooLong) {
+			log.Errorf("skipping niri event: %s", err)
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
 		if err != nil {
-			log.Debugf("error unmarshaling niri event: %s", err)
+			return err
+		}
+
+		if len(line) == 0 {
 			continue
 		}
-		if niriEvent.Ok != nil {
-			// response to EventStream request, ignore
+
+		event, err := parseEvent(line)
+		if errors.Is(err, errUnknownEvent) {
+			log.Warnf("%s", err)
 			continue
 		}
-		var event Event
-		var ok bool
-		// assign value of first non-nil field of niriEvent to event
-		for i := range reflect.TypeOf(niriEvent).Elem().NumField() {
-			field := reflect.ValueOf(niriEvent).Elem().Field(i)
-			if !field.IsNil() {
-				event, ok = field.Interface().(Event)
-				if !ok {
-					panic("fields on niri.NiriEvent must implement niri.Event")
-				}
-				break
-			}
+		if err != nil {
+			log.Errorf("error unmarshaling niri event: %s", err)
+			continue
 		}
 		if event != nil {
 			state.Update(event)
-		} else {
-			log.Warnf("received event with no fields set (unknown event type?)")
 		}
 	}
 }
+
+// parseEvent parses a single line of the event stream. It returns a nil event
+// for the reply to the EventStream request itself.
+func parseEvent(line []byte) (Event, error) {
+	niriEvent := new(NiriEvent)
+	err := json.Unmarshal(line, niriEvent)
+	if err != nil {
+		return nil, err
+	}
+	if niriEvent.Ok != nil {
+		// response to EventStream request, ignore
+		return nil, nil
+	}
+	// return value of first non-nil field of niriEvent
+	for i := range reflect.TypeOf(niriEvent).Elem().NumField() {
+		field := reflect.ValueOf(niriEvent).Elem().Field(i)
+		if !field.IsNil() {
+			event, ok := field.Interface().(Event)
+			if !ok {
+				panic("fields on niri.NiriEvent must implement niri.Event")
+			}
+			return event, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownEvent, line)
+}
+
+var errUnknownEvent = errors.New("received event with no fields set (unknown event type?)")
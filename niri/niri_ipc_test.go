@@ -0,0 +1,247 @@
+package niri
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeNiri returns a socket whose requests are answered by a fake niri that
+// replies Handled to every line. received is closed once the socket is closed
+// and holds every request line.
+func fakeNiri(t *testing.T) (socket Socket, received <-chan []string) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan []string, 1)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if _, err := server.Write([]byte("{\"Ok\":\"Handled\"}\n")); err != nil {
+				break
+			}
+		}
+		done <- lines
+	}()
+	socket = Socket{
+		conn:    &requestConn{conn: client, reader: bufio.NewReader(client)},
+		limiter: newRateLimiter(),
+	}
+	t.Cleanup(func() { client.Close() })
+	return socket, done
+}
+
+func closeWindow(id uint64) map[string]any {
+	return map[string]any{"Action": map[string]any{"CloseWindow": map[string]any{"id": id}}}
+}
+
+func TestRateLimit(t *testing.T) {
+	socket, received := fakeNiri(t)
+
+	// off by default
+	for id := range uint64(30) {
+		if err := socket.Request(closeWindow(id)); err != nil {
+			t.Fatalf("request %d: %s", id, err)
+		}
+	}
+	// but identical requests in quick succession are dropped regardless
+	if err := socket.Request(closeWindow(29)); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("repeated request: err = %v, want ErrRateLimited", err)
+	}
+
+	// the highest rate set by any instance applies
+	socket.SetRateLimit(1, 5)
+	socket.SetRateLimit(2, 10)
+	var sent, limited int
+	for id := range uint64(30) {
+		err := socket.Request(closeWindow(id))
+		switch {
+		case errors.Is(err, ErrRateLimited):
+			limited++
+		case err != nil:
+			t.Fatalf("request %d: %s", id, err)
+		default:
+			sent++
+		}
+	}
+	// a burst of one second's worth, give or take what refills meanwhile
+	if sent < 10 || sent > 12 || sent+limited != 30 {
+		t.Errorf("sent %d and limited %d requests, want about 10 and 20", sent, limited)
+	}
+
+	// a batch counts once, so it isn't cut short
+	socket.SetRateLimit(2, 0)
+	socket.SetRateLimit(1, 0)
+	socket.SetRateLimit(1, 1)
+	batch := make([]map[string]any, 30)
+	for id := range batch {
+		batch[id] = closeWindow(uint64(id))
+	}
+	if err := socket.RequestBatch(batch); err != nil {
+		t.Fatalf("batch: %s", err)
+	}
+	if err := socket.RequestBatch(batch); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("second batch: err = %v, want ErrRateLimited", err)
+	}
+
+	// and withdrawing the last rate turns limiting off again
+	socket.SetRateLimit(1, 0)
+	if err := socket.Request(closeWindow(100)); err != nil {
+		t.Errorf("after withdrawing: %s", err)
+	}
+
+	socket.conn.conn.Close()
+	if lines := <-received; len(lines) != 30+sent+30+1 {
+		t.Errorf("niri received %d requests, want %d", len(lines), 30+sent+30+1)
+	}
+}
+
+func TestEventStreamReconnects(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "niri.sock")
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the first connection stalls, the second fails, the third stays up
+	connections := make(chan int, 3)
+	go func() {
+		for n := 1; n <= 3; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "\"EventStream\"\n" {
+				t.Errorf("connection %d: got %q, %v", n, line, err)
+			}
+			fmt.Fprintf(conn, "{\"Ok\":\"Handled\"}\n{\"WorkspacesChanged\":{\"workspaces\":[{\"id\":%d,\"idx\":1,\"output\":\"DP-1\",\"is_active\":true,\"is_focused\":true}]}}\n", n)
+			connections <- n
+			if n == 2 {
+				conn.Close()
+			}
+			defer conn.Close()
+		}
+		<-t.Context().Done()
+	}()
+
+	state := NewNiriState()
+	stream := newEventStream(addr, nil)
+	socket := Socket{events: stream}
+	socket.SetWatchdog(1, 100*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		stream.run(state)
+		close(done)
+	}()
+
+	for want := 1; want <= 3; want++ {
+		select {
+		case n := <-connections:
+			if n != want {
+				t.Fatalf("got connection %d, want %d", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for connection %d", want)
+		}
+	}
+	// keep the third connection from timing out, too
+	socket.SetWatchdog(1, 0)
+	time.Sleep(50 * time.Millisecond)
+	if !state.Connected() {
+		t.Error("not connected after reconnecting")
+	}
+	if workspace, ok := state.ActiveWorkspace("DP-1"); !ok || workspace.Id != 3 {
+		t.Errorf("active workspace = %d, want 3 from the last connection", workspace.Id)
+	}
+
+	stream.close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run didn't return after close")
+	}
+	if state.Connected() {
+		t.Error("still connected after close")
+	}
+}
+
+func TestWatchdogShared(t *testing.T) {
+	socket := Socket{events: newEventStream("", nil)}
+	steps := []struct {
+		id       uint64
+		interval time.Duration
+		want     time.Duration
+	}{
+		{1, 5 * time.Second, 5 * time.Second},
+		// an instance without watchdog-ms doesn't turn it off for the others
+		{2, 0, 5 * time.Second},
+		{3, 2 * time.Second, 5 * time.Second},
+		{1, 0, 2 * time.Second},
+		{3, 0, 0},
+	}
+	for _, step := range steps {
+		socket.SetWatchdog(step.id, step.interval)
+		if timeout := socket.events.timeout; timeout != step.want {
+			t.Errorf("after setting %s for %d: timeout = %s, want %s", step.interval, step.id, timeout, step.want)
+		}
+	}
+}
+
+func TestRequestReconnectsAfterTimeout(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "niri.sock")
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					if n == 1 {
+						// hang, then reply too late
+						time.Sleep(requestTimeout + 200*time.Millisecond)
+						conn.Write([]byte("{\"Err\":\"late\"}\n"))
+						continue
+					}
+					conn.Write([]byte("{\"Ok\":\"Handled\"}\n"))
+				}
+			}()
+		}
+	}()
+
+	socket := Socket{conn: &requestConn{addr: addr}}
+	if err := socket.Request(closeWindow(1)); err == nil {
+		t.Fatal("expected the hung request to time out")
+	}
+	// the next request gets its own reply on a new connection
+	if err := socket.Request(closeWindow(2)); err != nil {
+		t.Fatalf("request after the timeout: %s", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if err := socket.Request(closeWindow(3)); err != nil {
+		t.Errorf("request after the late reply: %s", err)
+	}
+
+	socket.Close()
+	if err := socket.Request(closeWindow(4)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("request after Close: err = %v, want net.ErrClosed", err)
+	}
+}
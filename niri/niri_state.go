@@ -1,10 +1,18 @@
 package niri
 
 import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"wnw/log"
+	"wnw/metrics"
 )
 
 const None = uint64(0xffffffffffffffff)
@@ -16,9 +24,33 @@ type State struct {
 	currentWindowId    uint64
 	workspaces         map[uint64]*Workspace
 	windows            map[uint64]*Window
-	onUpdate           map[uint64]func(*State)
+	onUpdate           map[uint64]func(*State, Change)
+	sortsByRecency     map[uint64]bool // OnUpdate ids that sort by focus timestamp
+	flashesScreenshots map[uint64]bool // OnUpdate ids that flash on screenshots
+	scalesOverview     map[uint64]bool // OnUpdate ids that draw the overview differently
+	overviewOpen       bool
+	connected          bool // whether the event stream is being read
+	hasConnected       bool // whether the event stream was ever read
+	lastEvent          time.Time
+	lastScreenshot     time.Time
 
 	needsRedraw bool
+	change      Change // outputs affected by the event being processed
+}
+
+// Change describes which outputs an update may have affected.
+type Change struct {
+	outputs map[string]bool
+	all     bool
+}
+
+// AllOutputs is a Change affecting every output.
+var AllOutputs = Change{all: true}
+
+// Affects reports whether the change may affect what is displayed for output.
+// The empty output (following the focused output) is affected by everything.
+func (c Change) Affects(output string) bool {
+	return c.all || output == "" || c.outputs[output]
 }
 
 // NewNiriState initializes a new NiriState with empty maps for workspaces and windows.
@@ -29,11 +61,16 @@ func NewNiriState() *State {
 		workspaces:         make(map[uint64]*Workspace),
 		windows:            make(map[uint64]*Window),
 		needsRedraw:        false,
-		onUpdate:           make(map[uint64]func(*State)),
+		onUpdate:           make(map[uint64]func(*State, Change)),
+		sortsByRecency:     make(map[uint64]bool),
+		flashesScreenshots: make(map[uint64]bool),
+		scalesOverview:     make(map[uint64]bool),
 	}
 }
 
-func (s *State) OnUpdate(id uint64, f func(*State)) {
+// OnUpdate registers a callback called after every update that changes
+// something displayed, along with the outputs affected.
+func (s *State) OnUpdate(id uint64, f func(*State, Change)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.onUpdate[id] = f
@@ -43,30 +80,120 @@ func (s *State) RemoveOnUpdate(id uint64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.onUpdate, id)
+	delete(s.sortsByRecency, id)
+	delete(s.flashesScreenshots, id)
+	delete(s.scalesOverview, id)
+}
+
+// SetFlashesScreenshots sets whether the OnUpdate callback with the given id
+// shows [State.ScreenshotFlash]. Screenshots only trigger an update while some
+// callback does.
+func (s *State) SetFlashesScreenshots(id uint64, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enabled {
+		s.flashesScreenshots[id] = true
+	} else {
+		delete(s.flashesScreenshots, id)
+	}
+}
+
+// SetScalesOverview sets whether the OnUpdate callback with the given id draws
+// differently while the overview is open. Opening or closing the overview only
+// triggers an update while some callback does.
+func (s *State) SetScalesOverview(id uint64, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enabled {
+		s.scalesOverview[id] = true
+	} else {
+		delete(s.scalesOverview, id)
+	}
+}
+
+// SetSortsByRecency sets whether the OnUpdate callback with the given id
+// sorts windows by focus timestamp (see [ColumnSortRecency]). Focus timestamp
+// changes only trigger an update while some callback does.
+func (s *State) SetSortsByRecency(id uint64, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enabled {
+		s.sortsByRecency[id] = true
+	} else {
+		delete(s.sortsByRecency, id)
+	}
+}
+
+// notify calls every OnUpdate callback. Callbacks are called without holding
+// the lock, on a snapshot of the registered callbacks, so they may query the
+// state or (un)register callbacks themselves.
+func (s *State) notify(change Change) {
+	s.mu.RLock()
+	callbacks := make([]func(*State, Change), 0, len(s.onUpdate))
+	for _, f := range s.onUpdate {
+		callbacks = append(callbacks, f)
+	}
+	s.mu.RUnlock()
+
+	for _, f := range callbacks {
+		f(s, change)
+	}
+}
+
+// touchWorkspace marks the output of a workspace as affected by the current
+// event. Unknown workspaces affect every output. Must be called with the lock
+// held.
+func (s *State) touchWorkspace(id *uint64) {
+	if id == nil {
+		s.change.all = true
+		return
+	}
+	workspace := s.workspaces[*id]
+	if workspace == nil || workspace.Output == nil {
+		s.change.all = true
+		return
+	}
+	if s.change.outputs == nil {
+		s.change.outputs = make(map[string]bool)
+	}
+	s.change.outputs[*workspace.Output] = true
+}
+
+// touchWindow marks the output of a window's workspace as affected by the
+// current event. Must be called with the lock held.
+func (s *State) touchWindow(id uint64) {
+	window := s.windows[id]
+	if window == nil {
+		return
+	}
+	s.touchWorkspace(window.WorkspaceId)
 }
 
 func (s *State) Update(event Event) {
 	defer func() {
 		s.mu.RLock()
-		defer s.mu.RUnlock()
-		callbacks := make([]func(*State), 0, len(s.onUpdate))
-		for _, f := range s.onUpdate {
-			callbacks = append(callbacks, f)
-		}
-		defer func() {
-			for _, f := range callbacks {
-				f(s)
-			}
-		}()
+		redraw := s.needsRedraw
+		change := s.change
+		s.mu.RUnlock()
+		// skip redrawing for events that don't change anything displayed
+		if redraw {
+			s.notify(change)
+		}
 	}()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	log.Tracef("received event: %T", event)
+	metrics.EventsProcessed.Inc(event.Name())
+	s.lastEvent = time.Now()
 	s.needsRedraw = false
+	// events that can't be narrowed down to outputs below affect all of them
+	s.change = AllOutputs
 	switch event := event.(type) {
 	case *WorkspacesChanged:
+		// the snapshot may change which workspace is active on any output
+		s.needsRedraw = true
 		s.workspaces = make(map[uint64]*Workspace)
 		for _, wk := range event.Workspaces {
 			s.workspaces[wk.Id] = wk
@@ -76,11 +203,21 @@ func (s *State) Update(event Event) {
 				s.needsRedraw = true
 			}
 		}
+		if _, ok := s.workspaces[s.currentWorkspaceId]; !ok && s.currentWorkspaceId != None {
+			log.Tracef("  focused workspace removed: %d", s.currentWorkspaceId)
+			s.currentWorkspaceId = None
+			s.needsRedraw = true
+		}
 	case *WindowOpenedOrChanged:
 		s.needsRedraw = true
+		s.change = Change{}
 		window := event.Window
+		// the window may have moved from another output
+		s.touchWindow(window.Id)
 		s.windows[window.Id] = &window
+		s.touchWindow(window.Id)
 		if window.IsFocused && window.Id != s.currentWindowId {
+			s.touchWindow(s.currentWindowId)
 			log.Tracef("  newly focused window: %d", event.Window.Id)
 			for _, w := range s.windows {
 				w.IsFocused = false
@@ -90,16 +227,20 @@ func (s *State) Update(event Event) {
 			s.needsRedraw = true
 		}
 	case *WorkspaceActivated:
-		s.needsRedraw = true
-		wk, ok := s.workspaces[event.Id]
-		if !ok {
-			log.Errorf("workspace %d not found", event.Id)
+		wk := s.workspaces[event.Id]
+		if wk == nil {
+			// can happen during rapid workspace creation; the next
+			// WorkspacesChanged will bring the state back in sync
+			log.Warnf("activated workspace %d not found, ignoring", event.Id)
 			return
 		}
 		if wk.Output == nil {
 			log.Errorf("workspace %d has no output", wk.Id)
 			return
 		}
+		s.needsRedraw = true
+		s.change = Change{}
+		s.touchWorkspace(&wk.Id)
 		for _, workspace := range s.workspaces {
 			if workspace.Output == nil {
 				log.Errorf("workspace %d has no output", workspace.Id)
@@ -112,15 +253,33 @@ func (s *State) Update(event Event) {
 		wk.IsActive = true
 		if event.Focused {
 			log.Tracef("  workspace activated and focused: %d", event.Id)
+			// the previously focused output loses focus
+			s.touchWorkspace(&s.currentWorkspaceId)
 			for _, wk := range s.workspaces {
 				wk.IsFocused = false
 			}
 			s.currentWorkspaceId = event.Id
 			wk.IsFocused = true
 		}
+	case *WorkspaceActiveWindowChanged:
+		workspace := s.workspaces[event.WorkspaceId]
+		if workspace != nil {
+			workspace.ActiveWindowId = event.ActiveWindowId
+			s.needsRedraw = true
+			s.change = Change{}
+			s.touchWorkspace(&event.WorkspaceId)
+		}
 	case *WindowFocusChanged:
 		s.needsRedraw = true
+		s.change = Change{}
+		if s.currentWindowId == None || event.Id == nil {
+			// while no window has focus, every output marks its active
+			// window instead (see Segment)
+			s.change = AllOutputs
+		}
+		s.touchWindow(s.currentWindowId)
 		if event.Id != nil {
+			s.touchWindow(*event.Id)
 			log.Tracef("  window focus changed: %d -> %d", s.currentWindowId, *event.Id)
 			// unset focus for all windows
 			for _, window := range s.windows {
@@ -147,7 +306,15 @@ func (s *State) Update(event Event) {
 			return
 		}
 		win.FocusTimestamp = event.FocusTimestamp
+		if len(s.sortsByRecency) > 0 {
+			// the order of the window's column may have changed
+			s.needsRedraw = true
+			s.change = Change{}
+			s.touchWindow(event.Id)
+		}
 	case *WindowClosed:
+		s.change = Change{}
+		s.touchWindow(event.Id)
 		delete(s.windows, event.Id)
 		if s.currentWindowId == event.Id {
 			log.Tracef("  focused window closed: %d", event.Id)
@@ -155,36 +322,73 @@ func (s *State) Update(event Event) {
 		}
 		s.needsRedraw = true
 	case *WindowLayoutsChanged:
-		s.needsRedraw = true
+		s.change = Change{}
 		for _, change := range event.Changes {
 			window := s.windows[change.Id]
+			if window == nil {
+				log.Warnf("window %d not found in state", change.Id)
+				continue
+			}
 			window.Layout = change.WindowLayout
-			if window.WorkspaceId != nil && *window.WorkspaceId == s.currentWorkspaceId {
-				log.Tracef("  window layout on current workspace changed: %d", change.Id)
+			if window.WorkspaceId == nil {
+				continue
+			}
+			// only workspaces that are active on some output are displayed
+			workspace := s.workspaces[*window.WorkspaceId]
+			if workspace == nil || workspace.IsActive {
+				log.Tracef("  window layout on displayed workspace changed: %d", change.Id)
 				s.needsRedraw = true
+				s.touchWorkspace(window.WorkspaceId)
 			}
 		}
 	case *WindowsChanged:
 		s.needsRedraw = true
-		for _, window := range event.Windows {
-			w := window
-			s.windows[window.Id] = &w
-			if window.IsFocused && window.Id != s.currentWindowId {
-				log.Tracef("  newly focused window: %d", window.Id)
+		// the snapshot completely replaces the previous state, including focus
+		s.windows = make(map[uint64]*Window, len(event.Windows))
+		previousWindowId := s.currentWindowId
+		s.currentWindowId = None
+		for idx := range event.Windows {
+			// point into the snapshot so each stored window is distinct
+			window := &event.Windows[idx]
+			s.windows[window.Id] = window
+			if window.IsFocused {
+				if s.currentWindowId != None {
+					log.Warnf("multiple focused windows in snapshot: %d, %d", s.currentWindowId, window.Id)
+					s.windows[s.currentWindowId].IsFocused = false
+				}
 				s.currentWindowId = window.Id
 			}
 		}
+		if s.currentWindowId != previousWindowId {
+			log.Tracef("  newly focused window: %d", s.currentWindowId)
+		}
 	case *WindowUrgencyChanged:
 		window := s.windows[event.Id]
 		if window != nil {
 			window.IsUrgent = event.Urgent
 			s.needsRedraw = true
+			s.change = Change{}
+			s.touchWorkspace(window.WorkspaceId)
+		}
+	case *OverviewOpenedOrClosed:
+		s.overviewOpen = event.IsOpen
+		if len(s.scalesOverview) > 0 {
+			s.needsRedraw = true
+		}
+	case *ScreenshotCaptured:
+		s.lastScreenshot = time.Now()
+		if len(s.flashesScreenshots) > 0 {
+			s.needsRedraw = true
+			// redraw again once the flash is over
+			time.AfterFunc(ScreenshotFlashDuration, func() { s.notify(AllOutputs) })
 		}
 	case *WorkspaceUrgencyChanged:
 		workspace := s.workspaces[event.Id]
 		if workspace != nil {
 			workspace.IsUrgent = event.Urgent
 			s.needsRedraw = true
+			s.change = Change{}
+			s.touchWorkspace(&event.Id)
 		}
 	default:
 		log.Tracef("ignoring event: %T\n", event)
@@ -197,23 +401,267 @@ func (s *State) Update(event Event) {
 const urgentBegin = "<span color=\"#fb2c36\">"
 const urgentEnd = "</span>"
 
+// UrgentStyle controls how urgent columns are marked up in text mode.
+type UrgentStyle string
+
+const (
+	// UrgentStyleColor colors urgent columns red. This is the default.
+	UrgentStyleColor UrgentStyle = "color"
+	// UrgentStyleBold makes urgent columns bold, for themes where colored
+	// spans don't render well.
+	UrgentStyleBold UrgentStyle = "bold"
+	// UrgentStyleClass emits no markup; urgency is left to CSS classes.
+	UrgentStyleClass UrgentStyle = "class"
+	// UrgentStyleNone disables urgency styling.
+	UrgentStyleNone UrgentStyle = "none"
+)
+
+func (u *UrgentStyle) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "color", "bold", "class", "none":
+		*u = UrgentStyle(s)
+	default:
+		return fmt.Errorf("unknown urgent-style value %s (expected color, bold, class, or none)", s)
+	}
+	return nil
+}
+
+// markUrgent wraps symbol in the markup for the given style.
+func markUrgent(symbol string, style UrgentStyle) string {
+	switch style {
+	case UrgentStyleColor, "":
+		return urgentBegin + symbol + urgentEnd
+	case UrgentStyleBold:
+		return "<b>" + symbol + "</b>"
+	default:
+		return symbol
+	}
+}
+
 type Symbols struct {
 	Unfocused         string `json:"unfocused"`
 	Focused           string `json:"focused"`
 	UnfocusedFloating string `json:"unfocused-floating"`
 	FocusedFloating   string `json:"focused-floating"`
 	Empty             string `json:"empty"`
+	// Placeholder is displayed when the monitor or its active workspace
+	// can't be determined.
+	Placeholder string `json:"placeholder"`
+	// Special is displayed instead of the windows on special workspaces (see
+	// [TextOptions.SpecialWorkspaces]).
+	Special string `json:"special"`
+	// WorkspaceActive, WorkspaceOccupied, and WorkspaceEmpty are displayed for
+	// each workspace in workspaces mode.
+	WorkspaceActive   string `json:"workspace-active"`
+	WorkspaceOccupied string `json:"workspace-occupied"`
+	WorkspaceEmpty    string `json:"workspace-empty"`
+	// FormatIcons, if set, replaces the column symbols with icons indexed by
+	// the number of windows in the column.
+	FormatIcons FormatIcons `json:"format-icons"`
+}
+
+// FormatIcons are column symbols indexed by window count, like Waybar's
+// format-icons: the first icon is used for columns with one window, the
+// second for two, and the last for any more than that.
+type FormatIcons struct {
+	Unfocused []string `json:"unfocused"`
+	Focused   []string `json:"focused"`
 }
 
-func (s *State) Text(monitor string, symbols Symbols) string {
+// UnmarshalJSON accepts either a list of icons, used for all columns, or an
+// object with separate "unfocused" and "focused" lists.
+func (f *FormatIcons) UnmarshalJSON(data []byte) error {
+	var icons []string
+	if err := json.Unmarshal(data, &icons); err == nil {
+		f.Unfocused = icons
+		f.Focused = icons
+		return nil
+	}
+	type formatIcons FormatIcons
+	var object formatIcons
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return fmt.Errorf("format-icons must be a list or an object with unfocused/focused lists: %w", err)
+	}
+	*f = FormatIcons(object)
+	return nil
+}
+
+// icon returns the icon for a column with count windows, or fallback if there
+// are no icons.
+func icon(icons []string, count int, fallback string) string {
+	if len(icons) == 0 || count == 0 {
+		return fallback
+	}
+	return icons[min(count, len(icons))-1]
+}
+
+// TextOptions controls how [State.Text] renders a workspace.
+type TextOptions struct {
+	Symbols Symbols
+	Sort    SortOptions
+	// Separator is written between the tiled and floating groups.
+	Separator string
+	// SpecialWorkspaces matches the names of workspaces that are rendered as
+	// Symbols.Special instead of their windows, e.g. scratchpads.
+	SpecialWorkspaces *regexp.Regexp
+	// UrgentStyle controls the markup around urgent columns.
+	UrgentStyle UrgentStyle
+	// SymbolSeparator is written between symbols within a group, e.g. a hair
+	// space to keep wide glyphs apart.
+	SymbolSeparator string
+	// FloatingCollapse, if positive, collapses the unfocused floating windows
+	// into a single symbol with a count when there are at least this many
+	// floating windows, e.g. "∗³".
+	FloatingCollapse int
+	// Compact collapses runs of unfocused columns into a single symbol
+	// followed by a count, e.g. "⋅×5 ⊙ ⋅×3".
+	Compact bool
+	// WorkspacePrefixFormat is written before the symbols. "{name}" is
+	// replaced with the workspace name (or index, if unnamed) and "{idx}" with
+	// the workspace index.
+	WorkspacePrefixFormat string
+	// InvertEmphasis swaps the focused and unfocused symbols, so the focused
+	// column can be the subtle one.
+	InvertEmphasis bool
+}
+
+// symbols returns the symbols to use, swapped if InvertEmphasis is set.
+func (options TextOptions) symbols() Symbols {
+	symbols := options.Symbols
+	if options.InvertEmphasis {
+		symbols.Focused, symbols.Unfocused = symbols.Unfocused, symbols.Focused
+		symbols.FocusedFloating, symbols.UnfocusedFloating = symbols.UnfocusedFloating, symbols.FocusedFloating
+		symbols.FormatIcons.Focused, symbols.FormatIcons.Unfocused = symbols.FormatIcons.Unfocused, symbols.FormatIcons.Focused
+	}
+	return symbols
+}
+
+// compactColumns collapses runs of two or more unfocused columns into the
+// unfocused symbol followed by the run length. Runs are found by the segments'
+// classes, so columns drawn with different format-icons are collapsed
+// together; focused, active, and urgent columns are never collapsed.
+func compactColumns(segments []Segment, unfocused string) []Segment {
+	var compacted []Segment
+	for i := 0; i < len(segments); {
+		run := 0
+		for i+run < len(segments) && isPlainColumn(segments[i+run]) {
+			run++
+		}
+		if run < 2 {
+			compacted = append(compacted, segments[i])
+			i++
+			continue
+		}
+		compacted = append(compacted, Segment{
+			Glyph:    unfocused + "×" + strconv.Itoa(run),
+			Classes:  []string{"tiled"},
+			WindowId: None,
+		})
+		i += run
+	}
+	return compacted
+}
+
+// isPlainColumn reports whether a segment is a tiled column without any state
+// worth showing on its own.
+func isPlainColumn(segment Segment) bool {
+	return segment.HasClass("tiled") && !segment.HasClass("focused") && !segment.HasClass("active") && !segment.HasClass("urgent")
+}
+
+// collapseFloating replaces the unfocused floating symbols with a single
+// symbol followed by their count as superscript digits, e.g. "∗³".
+func collapseFloating(floating []string, symbols Symbols) []string {
+	var collapsed []string
+	unfocused := 0
+	for _, symbol := range floating {
+		if symbol == symbols.UnfocusedFloating {
+			unfocused++
+		} else {
+			collapsed = append(collapsed, symbol)
+		}
+	}
+	switch unfocused {
+	case 0:
+	case 1:
+		collapsed = append(collapsed, symbols.UnfocusedFloating)
+	default:
+		collapsed = append(collapsed, symbols.UnfocusedFloating+superscript(unfocused))
+	}
+	return collapsed
+}
+
+var superscriptDigits = []rune("⁰¹²³⁴⁵⁶⁷⁸⁹")
+
+func superscript(n int) string {
+	digits := []rune(strconv.Itoa(n))
+	for idx, digit := range digits {
+		digits[idx] = superscriptDigits[digit-'0']
+	}
+	return string(digits)
+}
+
+// workspacePrefix formats a workspace prefix. Called with the lock held.
+func workspacePrefix(format string, workspace *Workspace) string {
+	if format == "" {
+		return ""
+	}
+	idx := strconv.Itoa(int(workspace.Index))
+	name := idx
+	if workspace.Name != nil {
+		// the text is rendered as pango markup
+		name = html.EscapeString(*workspace.Name)
+	}
+	return strings.NewReplacer("{name}", name, "{idx}", idx).Replace(format)
+}
+
+// Segment is a single symbol of the text representation of a workspace: a
+// column of tiled windows, or a floating window.
+type Segment struct {
+	// Glyph is the symbol for the segment, without any markup.
+	Glyph string
+	// Classes describe the state of the segment: "focused", "urgent", and
+	// either "tiled" or "floating". While no window has focus (e.g. a launcher
+	// does), the segment of the workspace's active window is "active" and
+	// drawn with the focused symbol instead.
+	Classes []string
+	// WindowId is the focused window of a column (or its topmost window, if
+	// none is focused) or the floating window. It is None for empty columns.
+	WindowId uint64
+}
+
+// HasClass reports whether the segment has the given class.
+func (seg Segment) HasClass(class string) bool {
+	return slices.Contains(seg.Classes, class)
+}
+
+// Segments returns the symbols for the windows on the active workspace of the
+// given monitor (or the focused monitor, if empty): the tiled columns in
+// order, then the floating windows. ok is false if the workspace can't be
+// determined.
+func (s *State) Segments(monitor string, options TextOptions) (segments []Segment, ok bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	segments, _, ok = s.segments(monitor, options)
+	return
+}
+
+// segments implements Segments, also returning the workspace. Called with the
+// lock held.
+func (s *State) segments(monitor string, options TextOptions) (segments []Segment, workspace *Workspace, ok bool) {
+	symbols := options.symbols()
+
 	if monitor == "" {
-		workspace, ok := s.workspaces[s.currentWorkspaceId]
-		if !ok {
-			log.Errorf("current workspace %d has no output", s.currentWorkspaceId)
-			return "couldn't determine monitor"
+		workspace := s.focusedWorkspace()
+		if workspace == nil {
+			log.Warnf("couldn't determine monitor: current workspace %d not found", s.currentWorkspaceId)
+			return nil, nil, false
 		}
 		if workspace.Output != nil {
 			monitor = *workspace.Output
@@ -221,94 +669,493 @@ func (s *State) Text(monitor string, symbols Symbols) string {
 	}
 
 	if monitor == "" {
-		return "couldn't determine monitor"
+		log.Warnf("couldn't determine monitor: current workspace has no output")
+		return nil, nil, false
 	}
 
-	targetWorkspaceId := None
-	for _, workspace := range s.workspaces {
-		if workspace.Output != nil && *workspace.Output == monitor && workspace.IsActive {
-			targetWorkspaceId = workspace.Id
+	for _, wk := range s.workspaces {
+		if wk.Output != nil && *wk.Output == monitor && wk.IsActive {
+			workspace = wk
 			break
 		}
 	}
-	if targetWorkspaceId == None {
-		return "couldn't determine workspace"
+	if workspace == nil {
+		log.Warnf("couldn't determine workspace: no active workspace on %s", monitor)
+		return nil, nil, false
 	}
 
-	focusedColumn := -1
-	maxColumn := -1
-	urgentColumns := make(map[int]bool)
-	focusedFloating := uint64(0)
+	maxColumn := 0
+	columns := make(map[int][]*Window)
 	floatingWindows := make([]*Window, 0, len(s.windows))
 	for _, window := range s.windows {
-		if window.WorkspaceId != nil && *window.WorkspaceId == targetWorkspaceId {
-			location := window.Layout.PosInScrollingLayout
-			if location != nil {
-				col := int(location.X)
-				if window.IsFocused {
-					focusedColumn = col
-				}
-				if col > maxColumn {
-					maxColumn = col
-				}
-				if window.IsUrgent {
-					urgentColumns[col] = true
-				}
-			} else if window.IsFloating {
-				if window.IsFocused {
-					focusedFloating = window.Id
-				}
-				floatingWindows = append(floatingWindows, window)
-			}
+		if window.WorkspaceId == nil || *window.WorkspaceId != workspace.Id {
+			continue
+		}
+		location := window.Layout.PosInScrollingLayout
+		if location != nil {
+			col := int(location.X)
+			maxColumn = max(maxColumn, col)
+			columns[col] = append(columns[col], window)
+		} else if window.IsFloating && !options.Sort.HideFloating {
+			floatingWindows = append(floatingWindows, window)
 		}
 	}
 
-	// sort floating windows left-to-right
-	slices.SortFunc(floatingWindows, func(a, b *Window) int {
-		return int(a.Layout.TilePosInWorkspaceView.X) - int(b.Layout.TilePosInWorkspaceView.X)
-	})
+	sortFloating(floatingWindows, options.Sort.Floating)
 
-	var output strings.Builder
-	for i := 1; i <= int(maxColumn); i++ {
-		if urgentColumns[i] {
-			output.WriteString(urgentBegin)
+	// keep showing where focus will return to while e.g. a layer-shell
+	// surface has keyboard focus
+	isActive := func(window *Window) bool {
+		return s.currentWindowId == None && workspace.ActiveWindowId != nil && *workspace.ActiveWindowId == window.Id
+	}
+
+	segments = make([]Segment, 0, maxColumn+len(floatingWindows))
+	for col := 1; col <= maxColumn; col++ {
+		segment := Segment{Glyph: symbols.Unfocused, Classes: []string{"tiled"}, WindowId: None}
+		topmost := uint32(0)
+		for _, window := range columns[col] {
+			y := window.Layout.PosInScrollingLayout.Y
+			if segment.WindowId == None || y < topmost && !segment.HasClass("focused") && !segment.HasClass("active") {
+				segment.WindowId = window.Id
+				topmost = y
+			}
+			if window.IsFocused {
+				segment.Glyph = symbols.Focused
+				segment.Classes = append(segment.Classes, "focused")
+				segment.WindowId = window.Id
+			} else if isActive(window) {
+				segment.Glyph = symbols.Focused
+				segment.Classes = append(segment.Classes, "active")
+				segment.WindowId = window.Id
+			}
+			if window.IsUrgent && !segment.HasClass("urgent") {
+				segment.Classes = append(segment.Classes, "urgent")
+			}
 		}
-		if focusedColumn == i {
-			output.WriteString(symbols.Focused)
+		if segment.HasClass("focused") || segment.HasClass("active") {
+			segment.Glyph = icon(symbols.FormatIcons.Focused, len(columns[col]), segment.Glyph)
 		} else {
-			output.WriteString(symbols.Unfocused)
+			segment.Glyph = icon(symbols.FormatIcons.Unfocused, len(columns[col]), segment.Glyph)
 		}
-		if urgentColumns[i] {
-			output.WriteString(urgentEnd)
+		segments = append(segments, segment)
+	}
+	for _, window := range floatingWindows {
+		segment := Segment{Glyph: symbols.UnfocusedFloating, Classes: []string{"floating"}, WindowId: window.Id}
+		if window.IsFocused {
+			segment.Glyph = symbols.FocusedFloating
+			segment.Classes = append(segment.Classes, "focused")
+		} else if isActive(window) {
+			segment.Glyph = symbols.FocusedFloating
+			segment.Classes = append(segment.Classes, "active")
+		}
+		if window.IsUrgent {
+			segment.Classes = append(segment.Classes, "urgent")
 		}
+		segments = append(segments, segment)
+	}
+	return segments, workspace, true
+}
+
+func (s *State) Text(monitor string, options TextOptions) string {
+	symbols := options.symbols()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	segments, workspace, ok := s.segments(monitor, options)
+	if !ok {
+		return symbols.Placeholder
 	}
-	if len(floatingWindows) > 0 {
-		if maxColumn > 0 {
-			output.WriteRune(' ')
+	if isSpecial(workspace, options.SpecialWorkspaces) {
+		if symbols.Special == "" {
+			return ""
 		}
-		for i := 0; i < len(floatingWindows); i++ {
-			if floatingWindows[i].Id == focusedFloating {
-				output.WriteString(symbols.FocusedFloating)
-			} else {
-				output.WriteString(symbols.UnfocusedFloating)
-			}
+		return workspacePrefix(options.WorkspacePrefixFormat, workspace) + symbols.Special
+	}
+
+	if options.Compact {
+		segments = compactColumns(segments, symbols.Unfocused)
+	}
+
+	var columns, floating []string
+	for _, segment := range segments {
+		if segment.HasClass("floating") {
+			floating = append(floating, segment.Glyph)
+			continue
+		}
+		symbol := segment.Glyph
+		if segment.HasClass("urgent") {
+			symbol = markUrgent(symbol, options.UrgentStyle)
+		}
+		columns = append(columns, symbol)
+	}
+
+	var output strings.Builder
+	output.WriteString(strings.Join(columns, options.SymbolSeparator))
+	if len(floating) > 0 {
+		if len(columns) > 0 {
+			output.WriteString(options.Separator)
+		}
+		if options.FloatingCollapse > 0 && len(floating) >= options.FloatingCollapse {
+			floating = collapseFloating(floating, symbols)
 		}
+		output.WriteString(strings.Join(floating, options.SymbolSeparator))
 	}
 
 	if output.Len() == 0 {
 		return symbols.Empty
 	}
-	return output.String()
+	return workspacePrefix(options.WorkspacePrefixFormat, workspace) + output.String()
+}
+
+// isSpecial reports whether the workspace's name matches special.
+func isSpecial(workspace *Workspace, special *regexp.Regexp) bool {
+	return special != nil && workspace.Name != nil && special.MatchString(*workspace.Name)
 }
 
-func (s *State) Windows(monitor string) (tiled []*Window, floating []*Window) {
+// WorkspaceName returns the name of the workspace with the given id. ok is
+// false if the workspace is unknown or unnamed.
+func (s *State) WorkspaceName(id uint64) (name string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workspace, exists := s.workspaces[id]
+	if !exists || workspace.Name == nil {
+		return "", false
+	}
+	return *workspace.Name, true
+}
+
+// ActiveWorkspace returns a copy of the active workspace on the given monitor
+// (or the focused monitor, if empty).
+func (s *State) ActiveWorkspace(monitor string) (workspace Workspace, ok bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	if monitor == "" {
-		workspace, ok := s.workspaces[s.currentWorkspaceId]
-		if !ok {
-			log.Errorf("current workspace %d has no output", s.currentWorkspaceId)
+		focused := s.focusedWorkspace()
+		if focused == nil {
+			return Workspace{}, false
+		}
+		return *focused, true
+	}
+	for _, wk := range s.workspaces {
+		if wk.Output != nil && *wk.Output == monitor && wk.IsActive {
+			return *wk, true
+		}
+	}
+	return Workspace{}, false
+}
+
+func (s *State) setConnected(connected bool) {
+	s.mu.Lock()
+	changed := s.connected != connected
+	s.connected = connected
+	s.hasConnected = s.hasConnected || connected
+	s.mu.Unlock()
+
+	if changed {
+		s.notify(AllOutputs)
+	}
+}
+
+// Connected reports whether the niri event stream is currently being read.
+func (s *State) Connected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connected
+}
+
+// Disconnected reports whether the niri event stream was lost and hasn't been
+// reconnected yet. Unlike !Connected(), it is false before the event stream
+// is first read, e.g. while the module starts up.
+func (s *State) Disconnected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hasConnected && !s.connected
+}
+
+// Status returns a one-line summary of the state for troubleshooting.
+func (s *State) Status() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id := func(id uint64) string {
+		if id == None {
+			return "none"
+		}
+		return strconv.FormatUint(id, 10)
+	}
+	lastEvent := "never"
+	if !s.lastEvent.IsZero() {
+		lastEvent = time.Since(s.lastEvent).Round(time.Millisecond).String() + " ago"
+	}
+	return fmt.Sprintf(
+		"connected=%t last-event=%s workspaces=%d windows=%d focused-workspace=%s focused-window=%s overview=%t callbacks=%d",
+		s.connected, lastEvent, len(s.workspaces), len(s.windows),
+		id(s.currentWorkspaceId), id(s.currentWindowId), s.overviewOpen, len(s.onUpdate),
+	)
+}
+
+// ScreenshotFlashDuration is how long ScreenshotFlash reports true after a
+// screenshot is captured.
+const ScreenshotFlashDuration = 300 * time.Millisecond
+
+// ScreenshotFlash reports whether a screenshot was captured within the last
+// ScreenshotFlashDuration.
+func (s *State) ScreenshotFlash() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.lastScreenshot.IsZero() && time.Since(s.lastScreenshot) < ScreenshotFlashDuration
+}
+
+// OverviewOpen reports whether the niri overview is currently open.
+func (s *State) OverviewOpen() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.overviewOpen
+}
+
+// FocusedOutput returns the name of the output containing the focused
+// workspace, or an empty string if it is unknown.
+func (s *State) FocusedOutput() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workspace := s.focusedWorkspace()
+	if workspace == nil || workspace.Output == nil {
+		return ""
+	}
+	return *workspace.Output
+}
+
+// focusedWorkspace returns the focused workspace, falling back to any
+// workspace marked as focused if currentWorkspaceId is stale (e.g. the
+// workspace was just removed). Returns nil if there is no focused workspace.
+// Called with the lock held.
+func (s *State) focusedWorkspace() *Workspace {
+	if workspace, ok := s.workspaces[s.currentWorkspaceId]; ok {
+		return workspace
+	}
+	for _, workspace := range s.workspaces {
+		if workspace.IsFocused {
+			return workspace
+		}
+	}
+	return nil
+}
+
+// IsActiveWindow reports whether the window is the active window on its
+// workspace, regardless of whether it is globally focused.
+func (s *State) IsActiveWindow(window *Window) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if window.WorkspaceId == nil {
+		return false
+	}
+	workspace, ok := s.workspaces[*window.WorkspaceId]
+	if !ok || workspace.ActiveWindowId == nil {
+		return false
+	}
+	return *workspace.ActiveWindowId == window.Id
+}
+
+func (s *State) Windows(monitor string, sort SortOptions) (tiled []*Window, floating []*Window) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.windowsOn(monitor, sort)
+}
+
+// SortOptions controls which windows are returned by [State.Windows] and
+// drawn by [State.Text], and their order.
+type SortOptions struct {
+	Floating FloatingSort
+	Column   ColumnSort
+	// HideFloating leaves out floating windows entirely.
+	HideFloating bool
+}
+
+// ColumnSort is the order of tiled windows within a column.
+type ColumnSort string
+
+const (
+	// ColumnSortPosition sorts windows top-to-bottom. This is the default.
+	ColumnSortPosition ColumnSort = "position"
+	// ColumnSortRecency sorts the most recently focused windows first.
+	ColumnSortRecency ColumnSort = "recency"
+)
+
+func (c *ColumnSort) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "position", "recency":
+		*c = ColumnSort(s)
+	default:
+		return fmt.Errorf("unknown column-sort value %s (expected position or recency)", s)
+	}
+	return nil
+}
+
+// FloatingSort is the order of floating windows.
+type FloatingSort string
+
+const (
+	// FloatingSortPosition sorts floating windows left-to-right, then
+	// top-to-bottom. This is the default.
+	FloatingSortPosition FloatingSort = "position"
+	// FloatingSortId sorts floating windows by id, i.e. in the order they
+	// were opened, so they don't move around as they are dragged.
+	FloatingSortId FloatingSort = "id"
+)
+
+func (f *FloatingSort) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	switch s {
+	case "position", "id":
+		*f = FloatingSort(s)
+	default:
+		return fmt.Errorf("unknown floating-sort value %s (expected position or id)", s)
+	}
+	return nil
+}
+
+func sortFloating(floating []*Window, by FloatingSort) {
+	if by == FloatingSortId {
+		slices.SortFunc(floating, func(a, b *Window) int {
+			return cmp.Compare(a.Id, b.Id)
+		})
+		return
+	}
+	slices.SortFunc(floating, func(a, b *Window) int {
+		x := int(a.Layout.TilePosInWorkspaceView.X) - int(b.Layout.TilePosInWorkspaceView.X)
+		if x != 0 {
+			return x
+		}
+		return int(a.Layout.TilePosInWorkspaceView.Y) - int(b.Layout.TilePosInWorkspaceView.Y)
+	})
+}
+
+// WindowView is a read-only snapshot of a window, as returned by
+// [State.ActiveWindows].
+type WindowView struct {
+	Id         uint64
+	Title      string
+	AppId      string
+	IsFocused  bool
+	IsFloating bool
+	// Column and Row are the 1-based position of a tiled window in the
+	// scrolling layout. Both are 0 for floating windows.
+	Column uint32
+	Row    uint32
+}
+
+// ActiveWindows returns snapshots of the windows on the active workspace of
+// the given monitor (or the focused monitor, if empty), tiled windows first.
+//
+// Unlike [State.Windows], the returned values are copies and are safe to use
+// without racing further state updates.
+func (s *State) ActiveWindows(monitor string) []WindowView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tiled, floating := s.windowsOn(monitor, SortOptions{})
+	views := make([]WindowView, 0, len(tiled)+len(floating))
+	for _, window := range slices.Concat(tiled, floating) {
+		view := WindowView{
+			Id:         window.Id,
+			IsFocused:  window.IsFocused,
+			IsFloating: window.IsFloating,
+		}
+		if window.Title != nil {
+			view.Title = *window.Title
+		}
+		if window.AppId != nil {
+			view.AppId = *window.AppId
+		}
+		if pos := window.Layout.PosInScrollingLayout; pos != nil {
+			view.Column = pos.X
+			view.Row = pos.Y
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// WorkspaceView is a read-only snapshot of a workspace, as returned by
+// [State.Workspaces].
+type WorkspaceView struct {
+	Id        uint64
+	Index     uint8
+	Name      string // empty if unnamed
+	IsActive  bool
+	IsFocused bool
+	IsUrgent  bool
+	// Windows is the number of windows on the workspace.
+	Windows int
+}
+
+// Workspaces returns snapshots of the workspaces on the given monitor (or the
+// focused monitor, if empty), ordered by index.
+func (s *State) Workspaces(monitor string) []WorkspaceView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if monitor == "" {
+		focused := s.focusedWorkspace()
+		if focused == nil || focused.Output == nil {
+			return nil
+		}
+		monitor = *focused.Output
+	}
+
+	windows := make(map[uint64]int)
+	for _, window := range s.windows {
+		if window.WorkspaceId != nil {
+			windows[*window.WorkspaceId]++
+		}
+	}
+
+	var views []WorkspaceView
+	for _, workspace := range s.workspaces {
+		if workspace.Output == nil || *workspace.Output != monitor {
+			continue
+		}
+		view := WorkspaceView{
+			Id:        workspace.Id,
+			Index:     workspace.Index,
+			IsActive:  workspace.IsActive,
+			IsFocused: workspace.IsFocused,
+			IsUrgent:  workspace.IsUrgent,
+			Windows:   windows[workspace.Id],
+		}
+		if workspace.Name != nil {
+			view.Name = *workspace.Name
+		}
+		views = append(views, view)
+	}
+	slices.SortFunc(views, func(a, b WorkspaceView) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+	return views
+}
+
+// windowsOn returns the tiled and floating windows on the active workspace of
+// the given monitor. Called with the lock held.
+func (s *State) windowsOn(monitor string, sort SortOptions) (tiled []*Window, floating []*Window) {
+	if monitor == "" {
+		workspace := s.focusedWorkspace()
+		if workspace == nil {
+			log.Errorf("current workspace %d not found", s.currentWorkspaceId)
 			return nil, nil
 		}
 		if workspace.Output != nil {
@@ -342,16 +1189,21 @@ func (s *State) Windows(monitor string) (tiled []*Window, floating []*Window) {
 		if x != 0 {
 			return x
 		}
+		if sort.Column == ColumnSortRecency {
+			if b.FocusTimestamp.Before(a.FocusTimestamp) {
+				return -1
+			}
+			if a.FocusTimestamp.Before(b.FocusTimestamp) {
+				return 1
+			}
+		}
 		return int(a.Layout.PosInScrollingLayout.Y) - int(b.Layout.PosInScrollingLayout.Y)
 	})
 
-	slices.SortFunc(floating, func(a, b *Window) int {
-		x := int(a.Layout.TilePosInWorkspaceView.X) - int(b.Layout.TilePosInWorkspaceView.X)
-		if x != 0 {
-			return x
-		}
-		return int(a.Layout.TilePosInWorkspaceView.Y) - int(b.Layout.TilePosInWorkspaceView.Y)
-	})
+	if sort.HideFloating {
+		floating = nil
+	}
+	sortFloating(floating, sort.Floating)
 
 	return
 }
@@ -0,0 +1,660 @@
+package niri
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testOptions = TextOptions{
+	Symbols: Symbols{
+		Unfocused:         ".",
+		Focused:           "o",
+		UnfocusedFloating: "+",
+		FocusedFloating:   "*",
+		Placeholder:       "?",
+	},
+	Separator:   " | ",
+	UrgentStyle: UrgentStyleBold,
+}
+
+// replay feeds the first n events of testdata/name.jsonl into a new State, or
+// all of them if n is negative. The leading {"Ok":"Handled"} reply is not
+// counted.
+func replay(t *testing.T, name string, n int) *State {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := string(data)
+	if n >= 0 {
+		lines := strings.SplitAfter(input, "\n")
+		input = strings.Join(lines[:min(n+1, len(lines))], "")
+	}
+	state, err := ReplayEvents(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("replaying %s: %s", name, err)
+	}
+	return state
+}
+
+func focusedWindows(s *State) []uint64 {
+	var ids []uint64
+	for _, window := range s.windows {
+		if window.IsFocused {
+			ids = append(ids, window.Id)
+		}
+	}
+	return ids
+}
+
+func TestReplayFocus(t *testing.T) {
+	tests := []struct {
+		events  int
+		text    string
+		focused uint64
+	}{
+		{2, "o..", 10},
+		{3, ".o.", 11},
+		{5, "..o", 12},
+		// the final WindowFocusChanged has no trailing newline; the column
+		// stays marked as the workspace's active window
+		{-1, "..o", None},
+	}
+	for _, tt := range tests {
+		s := replay(t, "focus", tt.events)
+		if text := s.Text("DP-1", testOptions); text != tt.text {
+			t.Errorf("after %d events: Text = %q, want %q", tt.events, text, tt.text)
+		}
+		if s.currentWindowId != tt.focused {
+			t.Errorf("after %d events: currentWindowId = %d, want %d", tt.events, s.currentWindowId, tt.focused)
+		}
+		focused := focusedWindows(s)
+		if tt.focused == None && len(focused) != 0 {
+			t.Errorf("after %d events: windows %v still focused", tt.events, focused)
+		}
+		if tt.focused != None && (len(focused) != 1 || focused[0] != tt.focused) {
+			t.Errorf("after %d events: focused windows = %v, want [%d]", tt.events, focused, tt.focused)
+		}
+	}
+
+	s := replay(t, "focus", -1)
+	segments, _ := s.Segments("DP-1", testOptions)
+	if last := segments[len(segments)-1]; !last.HasClass("active") || last.HasClass("focused") {
+		t.Errorf("last segment classes = %v, want active but not focused", last.Classes)
+	}
+}
+
+func TestReplayFloating(t *testing.T) {
+	s := replay(t, "floating", 3)
+	// floating windows are ordered by position: 22 is left of 21
+	if text := s.Text("DP-1", testOptions); text != ". | +*" {
+		t.Errorf("Text = %q, want %q", text, ". | +*")
+	}
+
+	s = replay(t, "floating", -1)
+	if text := s.Text("DP-1", testOptions); text != "+*+" {
+		t.Errorf("after floating 20: Text = %q, want %q", text, "+*+")
+	}
+	tiled, floating := s.Windows("DP-1", SortOptions{})
+	if len(tiled) != 0 {
+		t.Errorf("tiled = %d windows, want 0", len(tiled))
+	}
+	var ids []uint64
+	for _, window := range floating {
+		ids = append(ids, window.Id)
+	}
+	if want := []uint64{22, 21, 20}; !slices.Equal(ids, want) {
+		t.Errorf("floating = %v, want %v", ids, want)
+	}
+}
+
+func TestReplayUrgency(t *testing.T) {
+	urgent := func(s *State) (windows []uint64, workspaces []uint64) {
+		for _, window := range s.windows {
+			if window.IsUrgent {
+				windows = append(windows, window.Id)
+			}
+		}
+		for _, workspace := range s.workspaces {
+			if workspace.IsUrgent {
+				workspaces = append(workspaces, workspace.Id)
+			}
+		}
+		slices.Sort(windows)
+		slices.Sort(workspaces)
+		return windows, workspaces
+	}
+
+	tests := []struct {
+		events     int
+		windows    []uint64
+		workspaces []uint64
+	}{
+		{3, []uint64{31}, nil},
+		{4, []uint64{31}, []uint64{1}},
+		{6, []uint64{31, 32}, []uint64{1, 2}},
+		{-1, []uint64{32}, []uint64{2}},
+	}
+	for _, tt := range tests {
+		s := replay(t, "urgency", tt.events)
+		windows, workspaces := urgent(s)
+		if !slices.Equal(windows, tt.windows) {
+			t.Errorf("after %d events: urgent windows = %v, want %v", tt.events, windows, tt.windows)
+		}
+		if !slices.Equal(workspaces, tt.workspaces) {
+			t.Errorf("after %d events: urgent workspaces = %v, want %v", tt.events, workspaces, tt.workspaces)
+		}
+	}
+
+	// 31 is in column 7; the column is marked without indexing past the
+	// columns that exist
+	s := replay(t, "urgency", 3)
+	want := "o.....<b>.</b>"
+	if text := s.Text("DP-1", testOptions); text != want {
+		t.Errorf("Text = %q, want %q", text, want)
+	}
+}
+
+func TestReplayMultiMonitor(t *testing.T) {
+	tests := []struct {
+		events        int
+		focusedOutput string
+		texts         map[string]string
+	}{
+		{2, "DP-1", map[string]string{"DP-1": "o.", "HDMI-A-1": ".", "": "o."}},
+		{4, "HDMI-A-1", map[string]string{"DP-1": "..", "HDMI-A-1": "o", "": "o"}},
+		// workspace 3 is activated on DP-1 without taking focus
+		{5, "HDMI-A-1", map[string]string{"DP-1": ".", "HDMI-A-1": "o", "": "o"}},
+		{-1, "HDMI-A-1", map[string]string{"DP-1": ".", "HDMI-A-1": "o.", "": "o."}},
+	}
+	for _, tt := range tests {
+		s := replay(t, "multi_monitor", tt.events)
+		if output := s.FocusedOutput(); output != tt.focusedOutput {
+			t.Errorf("after %d events: FocusedOutput = %q, want %q", tt.events, output, tt.focusedOutput)
+		}
+		for monitor, want := range tt.texts {
+			if text := s.Text(monitor, testOptions); text != want {
+				t.Errorf("after %d events: Text(%q) = %q, want %q", tt.events, monitor, text, want)
+			}
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		max   int
+		lines []string
+		errs  []error
+	}{
+		{"trailing newline", "a\nb\n", 16, []string{"a", "b"}, []error{nil, nil}},
+		{"no trailing newline", "a\nb", 16, []string{"a", "b"}, []error{nil, nil}},
+		{"empty line", "a\n\nb", 16, []string{"a", "", "b"}, []error{nil, nil, nil}},
+		{"too long", "abcdef\nb\n", 4, []string{"", "b"}, []error{errLineTooLong, nil}},
+		{"last line too long", "a\nbcdefg", 4, []string{"a", ""}, []error{nil, errLineTooLong}},
+		// longer than bufio's buffer, so ReadSlice returns ErrBufferFull
+		{"long line", strings.Repeat("x", 5000) + "\ny", 8192, []string{strings.Repeat("x", 5000), "y"}, []error{nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+			for i, want := range tt.lines {
+				line, err := readLine(r, tt.max)
+				if !errors.Is(err, tt.errs[i]) {
+					t.Fatalf("line %d: err = %v, want %v", i, err, tt.errs[i])
+				}
+				if err == nil && string(line) != want {
+					t.Errorf("line %d = %q, want %q", i, line, want)
+				}
+			}
+			if _, err := readLine(r, tt.max); !errors.Is(err, io.EOF) {
+				t.Errorf("after the last line: err = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// TestConcurrentUpdates exercises Update alongside the readers and callback
+// registration; run with -race.
+func TestConcurrentUpdates(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "multi_monitor.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")[1:]
+
+	s := NewNiriState()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for range 20 {
+			for _, line := range lines {
+				event, err := parseEvent([]byte(line))
+				if err != nil {
+					t.Errorf("parsing %s: %s", line, err)
+					return
+				}
+				s.Update(event)
+			}
+		}
+	}()
+
+	for _, monitor := range []string{"", "DP-1", "HDMI-A-1"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.Segments(monitor, testOptions)
+				s.Text(monitor, testOptions)
+				s.Workspaces(monitor)
+				s.Windows(monitor, SortOptions{})
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for id := uint64(0); ; id++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.OnUpdate(id, func(s *State, change Change) {
+				if change.Affects("DP-1") {
+					s.Text("DP-1", testOptions)
+				}
+			})
+			if id > 0 {
+				s.RemoveOnUpdate(id - 1)
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+func testWorkspace(id uint64, idx uint8, output string, focused bool) *Workspace {
+	return &Workspace{Id: id, Index: idx, Output: &output, IsActive: true, IsFocused: focused}
+}
+
+func tiledWindow(id, workspace uint64, col, row uint32) Window {
+	return Window{
+		Id:          id,
+		WorkspaceId: &workspace,
+		Layout:      WindowLayout{PosInScrollingLayout: &Vec2[uint32]{X: col, Y: row}},
+	}
+}
+
+// newTestState returns a State with workspace 1 focused on DP-1 and the given
+// windows.
+func newTestState(windows ...Window) *State {
+	s := NewNiriState()
+	s.Update(&WorkspacesChanged{Workspaces: []*Workspace{testWorkspace(1, 1, "DP-1", true)}})
+	s.Update(&WindowsChanged{Windows: windows})
+	return s
+}
+
+func TestUrgentHighColumn(t *testing.T) {
+	focused := tiledWindow(1, 1, 1, 1)
+	focused.IsFocused = true
+	urgent := tiledWindow(2, 1, 9, 1)
+	urgent.IsUrgent = true
+	s := newTestState(focused, urgent)
+
+	want := "o.......<b>.</b>"
+	if text := s.Text("DP-1", testOptions); text != want {
+		t.Errorf("Text = %q, want %q", text, want)
+	}
+	segments, _ := s.Segments("DP-1", testOptions)
+	if len(segments) != 9 {
+		t.Fatalf("got %d segments, want 9", len(segments))
+	}
+	for i, segment := range segments {
+		if segment.HasClass("urgent") != (i == 8) {
+			t.Errorf("segment %d classes = %v", i+1, segment.Classes)
+		}
+	}
+}
+
+func TestCompactFormatIcons(t *testing.T) {
+	options := testOptions
+	options.Compact = true
+	options.SymbolSeparator = "|"
+	options.Symbols.FormatIcons = FormatIcons{Unfocused: []string{"a", "b"}, Focused: []string{"O"}}
+
+	focused := tiledWindow(1, 1, 1, 1)
+	focused.IsFocused = true
+	urgent := tiledWindow(6, 1, 5, 1)
+	urgent.IsUrgent = true
+	s := newTestState(
+		focused,
+		tiledWindow(2, 1, 2, 1),
+		tiledWindow(3, 1, 3, 1),
+		tiledWindow(4, 1, 3, 2),
+		tiledWindow(5, 1, 4, 1),
+		urgent,
+		tiledWindow(7, 1, 6, 1),
+		tiledWindow(8, 1, 7, 1),
+	)
+
+	// the run spans columns with different icons, and each group is
+	// separated exactly once
+	want := "O|.×3|<b>a</b>|.×2"
+	if text := s.Text("DP-1", options); text != want {
+		t.Errorf("Text = %q, want %q", text, want)
+	}
+}
+
+func TestWorkspacesChangedRemovesCurrent(t *testing.T) {
+	focused := tiledWindow(1, 1, 1, 1)
+	focused.IsFocused = true
+	s := newTestState(focused, tiledWindow(2, 2, 1, 1))
+
+	// workspace 1 goes away without another one taking focus
+	s.Update(&WorkspacesChanged{Workspaces: []*Workspace{testWorkspace(2, 1, "DP-1", false)}})
+
+	if s.currentWorkspaceId != None {
+		t.Errorf("currentWorkspaceId = %d, want None", s.currentWorkspaceId)
+	}
+	if text := s.Text("", testOptions); text != "?" {
+		t.Errorf(`Text("") = %q, want the placeholder`, text)
+	}
+	if text := s.Text("DP-1", testOptions); text != "." {
+		t.Errorf(`Text("DP-1") = %q, want "."`, text)
+	}
+	if output := s.FocusedOutput(); output != "" {
+		t.Errorf("FocusedOutput = %q, want none", output)
+	}
+	s.Workspaces("")
+	s.Windows("", SortOptions{})
+	s.ActiveWindows("")
+}
+
+func TestWindowsChangedMovesFocus(t *testing.T) {
+	first := []Window{tiledWindow(1, 1, 1, 1), tiledWindow(2, 1, 2, 1)}
+	first[0].IsFocused = true
+	second := []Window{tiledWindow(1, 1, 1, 1), tiledWindow(2, 1, 2, 1)}
+	second[1].IsFocused = true
+
+	s := newTestState(first...)
+	s.Update(&WindowsChanged{Windows: second})
+
+	if focused := focusedWindows(s); !slices.Equal(focused, []uint64{2}) {
+		t.Errorf("focused windows = %v, want [2]", focused)
+	}
+	if s.currentWindowId != 2 {
+		t.Errorf("currentWindowId = %d, want 2", s.currentWindowId)
+	}
+	if text := s.Text("DP-1", testOptions); text != ".o" {
+		t.Errorf("Text = %q, want %q", text, ".o")
+	}
+}
+
+func TestWindowsChangedNoAliasing(t *testing.T) {
+	s := newTestState(tiledWindow(1, 1, 1, 1), tiledWindow(2, 1, 2, 1))
+
+	first, second := s.windows[1], s.windows[2]
+	if first == second {
+		t.Fatal("windows 1 and 2 share a pointer")
+	}
+	if first.Id != 1 || second.Id != 2 {
+		t.Fatalf("stored ids = %d, %d, want 1, 2", first.Id, second.Id)
+	}
+	s.Update(&WindowUrgencyChanged{Id: 1, Urgent: true})
+	if second.IsUrgent {
+		t.Error("marking window 1 urgent changed window 2")
+	}
+}
+
+func TestWorkspaceActivatedUnknown(t *testing.T) {
+	focused := tiledWindow(1, 1, 1, 1)
+	focused.IsFocused = true
+	s := newTestState(focused)
+	got := changes(s)
+
+	for _, event := range []*WorkspaceActivated{{Id: 42, Focused: true}, {Id: 42, Focused: false}} {
+		s.Update(event)
+	}
+	if len(*got) != 0 {
+		t.Errorf("updated %d times for an unknown workspace, want 0", len(*got))
+	}
+	if s.currentWorkspaceId != 1 {
+		t.Errorf("currentWorkspaceId = %d, want 1", s.currentWorkspaceId)
+	}
+	if text := s.Text("DP-1", testOptions); text != "o" {
+		t.Errorf("Text = %q, want %q", text, "o")
+	}
+}
+
+func TestTextEmpty(t *testing.T) {
+	options := testOptions
+	options.Symbols.Empty = "-"
+	options.SpecialWorkspaces = regexp.MustCompile("^scratch$")
+
+	s := newTestState()
+	name := "scratch"
+	special := testWorkspace(2, 1, "HDMI-A-1", false)
+	special.Name = &name
+	s.Update(&WorkspacesChanged{Workspaces: []*Workspace{testWorkspace(1, 1, "DP-1", true), special}})
+
+	tests := []struct {
+		monitor string
+		want    string
+	}{
+		{"DP-1", "-"},
+		// special and missing workspaces have their own symbols
+		{"HDMI-A-1", ""},
+		{"DP-2", "?"},
+	}
+	for _, tt := range tests {
+		if text := s.Text(tt.monitor, options); text != tt.want {
+			t.Errorf("Text(%q) = %q, want %q", tt.monitor, text, tt.want)
+		}
+	}
+}
+
+func TestDisconnected(t *testing.T) {
+	s := NewNiriState()
+	var notified int
+	s.OnUpdate(1, func(*State, Change) { notified++ })
+
+	steps := []struct {
+		connected    bool
+		disconnected bool
+		notified     int
+	}{
+		// not yet connected isn't a disconnect
+		{false, false, 0},
+		{true, false, 1},
+		{false, true, 2},
+		{false, true, 2},
+		{true, false, 3},
+	}
+	if s.Disconnected() {
+		t.Error("disconnected before connecting")
+	}
+	for idx, step := range steps {
+		s.setConnected(step.connected)
+		if s.Disconnected() != step.disconnected {
+			t.Errorf("step %d: Disconnected = %t, want %t", idx, s.Disconnected(), step.disconnected)
+		}
+		if notified != step.notified {
+			t.Errorf("step %d: notified %d times, want %d", idx, notified, step.notified)
+		}
+	}
+}
+
+// twoOutputs returns a State with workspace 1 focused on DP-1, workspace 2
+// active on HDMI-A-1, and the given windows.
+func twoOutputs(windows ...Window) *State {
+	s := NewNiriState()
+	s.Update(&WorkspacesChanged{Workspaces: []*Workspace{
+		testWorkspace(1, 1, "DP-1", true),
+		testWorkspace(2, 1, "HDMI-A-1", false),
+	}})
+	s.Update(&WindowsChanged{Windows: windows})
+	return s
+}
+
+// changes records the Change of every update.
+func changes(s *State) *[]Change {
+	var changes []Change
+	s.OnUpdate(100, func(_ *State, change Change) { changes = append(changes, change) })
+	return &changes
+}
+
+func TestFocusTimestampRecency(t *testing.T) {
+	s := twoOutputs(tiledWindow(1, 1, 1, 1), tiledWindow(2, 2, 1, 1), tiledWindow(3, 2, 1, 2))
+	got := changes(s)
+
+	s.Update(&WindowFocusTimestampChanged{Id: 3, FocusTimestamp: &Timestamp{Secs: 1}})
+	if len(*got) != 0 {
+		t.Errorf("updated %d times without recency sorting, want 0", len(*got))
+	}
+
+	s.SetSortsByRecency(7, true)
+	s.Update(&WindowFocusTimestampChanged{Id: 3, FocusTimestamp: &Timestamp{Secs: 2}})
+	if len(*got) != 1 {
+		t.Fatalf("updated %d times with recency sorting, want 1", len(*got))
+	}
+	if change := (*got)[0]; !change.Affects("HDMI-A-1") || change.Affects("DP-1") {
+		t.Errorf("change affects HDMI-A-1: %t, DP-1: %t, want only HDMI-A-1", change.Affects("HDMI-A-1"), change.Affects("DP-1"))
+	}
+	tiled, _ := s.Windows("HDMI-A-1", SortOptions{Column: ColumnSortRecency})
+	if len(tiled) != 2 || tiled[0].Id != 3 {
+		t.Errorf("most recently focused window isn't sorted first")
+	}
+
+	s.RemoveOnUpdate(7)
+	s.Update(&WindowFocusTimestampChanged{Id: 2, FocusTimestamp: &Timestamp{Secs: 3}})
+	if len(*got) != 1 {
+		t.Errorf("updated after the recency-sorted callback was removed")
+	}
+}
+
+func TestOverviewScale(t *testing.T) {
+	s := twoOutputs()
+	got := changes(s)
+
+	s.Update(&OverviewOpenedOrClosed{IsOpen: true})
+	if len(*got) != 0 {
+		t.Errorf("updated %d times without overview scaling, want 0", len(*got))
+	}
+	if !s.OverviewOpen() {
+		t.Error("OverviewOpen is false after the overview opened")
+	}
+
+	s.SetScalesOverview(7, true)
+	s.Update(&OverviewOpenedOrClosed{IsOpen: false})
+	if len(*got) != 1 {
+		t.Errorf("updated %d times with overview scaling, want 1", len(*got))
+	}
+
+	s.RemoveOnUpdate(7)
+	s.Update(&OverviewOpenedOrClosed{IsOpen: true})
+	if len(*got) != 1 {
+		t.Errorf("updated after the overview-scaled callback was removed")
+	}
+}
+
+func TestScreenshotFlash(t *testing.T) {
+	s := twoOutputs()
+	var mu sync.Mutex
+	updates := 0
+	s.OnUpdate(100, func(*State, Change) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates++
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return updates
+	}
+
+	s.Update(&ScreenshotCaptured{})
+	time.Sleep(ScreenshotFlashDuration + 100*time.Millisecond)
+	if n := count(); n != 0 {
+		t.Errorf("updated %d times without flash-on-screenshot, want 0", n)
+	}
+
+	s.SetFlashesScreenshots(7, true)
+	s.Update(&ScreenshotCaptured{})
+	if !s.ScreenshotFlash() {
+		t.Error("ScreenshotFlash is false right after a screenshot")
+	}
+	if n := count(); n != 1 {
+		t.Errorf("updated %d times after the screenshot, want 1", n)
+	}
+	time.Sleep(ScreenshotFlashDuration + 100*time.Millisecond)
+	if s.ScreenshotFlash() {
+		t.Error("ScreenshotFlash is still true after the flash")
+	}
+	if n := count(); n != 2 {
+		t.Errorf("updated %d times after the flash, want 2", n)
+	}
+}
+
+func TestFocusChangedToNoneAffectsAllOutputs(t *testing.T) {
+	a := tiledWindow(1, 1, 1, 1)
+	a.IsFocused = true
+	b := tiledWindow(2, 2, 1, 1)
+	s := twoOutputs(a, b)
+	s.Update(&WorkspaceActiveWindowChanged{WorkspaceId: 1, ActiveWindowId: &a.Id})
+	s.Update(&WorkspaceActiveWindowChanged{WorkspaceId: 2, ActiveWindowId: &b.Id})
+	got := changes(s)
+
+	steps := []struct {
+		focus uint64
+		texts map[string]string
+	}{
+		// B's active window is drawn as focused while nothing has focus
+		{None, map[string]string{"DP-1": "o", "HDMI-A-1": "o"}},
+		{1, map[string]string{"DP-1": "o", "HDMI-A-1": "."}},
+		{2, map[string]string{"DP-1": ".", "HDMI-A-1": "o"}},
+	}
+	for idx, step := range steps {
+		before := map[string]string{}
+		for monitor := range step.texts {
+			before[monitor] = s.Text(monitor, testOptions)
+		}
+		event := &WindowFocusChanged{}
+		if step.focus != None {
+			event.Id = &step.focus
+		}
+		s.Update(event)
+
+		change := (*got)[len(*got)-1]
+		for monitor, want := range step.texts {
+			text := s.Text(monitor, testOptions)
+			if text != want {
+				t.Errorf("step %d: Text(%q) = %q, want %q", idx, monitor, text, want)
+			}
+			if text != before[monitor] && !change.Affects(monitor) {
+				t.Errorf("step %d: %s changed from %q to %q, but the change doesn't affect it", idx, monitor, before[monitor], text)
+			}
+		}
+	}
+}
@@ -3,6 +3,9 @@ package niri
 import (
 	"encoding/json"
 	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
 // Toplevel window.
@@ -98,6 +101,38 @@ type Timestamp struct {
 	Nanos uint32 `json:"nanos"`
 }
 
+// Before reports whether t is earlier than u. A nil timestamp is earlier than
+// any non-nil timestamp.
+func (t *Timestamp) Before(u *Timestamp) bool {
+	if t == nil || u == nil {
+		return t == nil && u != nil
+	}
+	if t.Secs != u.Secs {
+		return t.Secs < u.Secs
+	}
+	return t.Nanos < u.Nanos
+}
+
+// Sub returns the duration t-u.
+func (t Timestamp) Sub(u Timestamp) time.Duration {
+	secs := time.Duration(t.Secs) - time.Duration(u.Secs)
+	nanos := time.Duration(t.Nanos) - time.Duration(u.Nanos)
+	return secs*time.Second + nanos
+}
+
+// Now returns the current time on the monotonic clock niri uses for
+// timestamps such as [Window.FocusTimestamp].
+func Now() (Timestamp, error) {
+	var ts syscall.Timespec
+	// CLOCK_MONOTONIC; the syscall package doesn't export clock ids
+	const clockMonotonic = 1
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return Timestamp{}, fmt.Errorf("clock_gettime: %w", errno)
+	}
+	return Timestamp{Secs: uint64(ts.Sec), Nanos: uint32(ts.Nsec)}, nil
+}
+
 // A workspace.
 type Workspace struct {
 	// Unique id of this workspace.
@@ -149,6 +184,31 @@ type KeyboardLayouts struct {
 	CurrentIdx uint8 `json:"current_idx"`
 }
 
+// Connected output. Only the fields used by the module are included.
+type Output struct {
+	// Name of the output.
+	Name string `json:"name"`
+	// Logical output information.
+	//
+	// None if the output is not mapped to any logical output (for example, if
+	// it is disabled).
+	Logical *LogicalOutput `json:"logical"`
+}
+
+// Logical output in the compositor's coordinate space.
+type LogicalOutput struct {
+	// Logical X position.
+	X int32 `json:"x"`
+	// Logical Y position.
+	Y int32 `json:"y"`
+	// Width in logical pixels.
+	Width uint32 `json:"width"`
+	// Height in logical pixels.
+	Height uint32 `json:"height"`
+	// Scale factor.
+	Scale float64 `json:"scale"`
+}
+
 // Numeric is a type constraint for numeric types.
 type Numeric interface {
 	~int | ~int8 | ~int16 | ~int32 | ~int64 |